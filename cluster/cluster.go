@@ -139,7 +139,7 @@ func NewClusterNode(file, name string) (ClusterNode, error) {
 	}
 
 	for j, f := range nodeCfg.Fileservers {
-		res.fileservers[j] = fileserver.NewServer(":" + f.Port, f.Mnt)
+		res.fileservers[j] = fileserver.NewServer(":" + f.Port, f.Mounts(), f.Writable, f.Reserve)
 	}
 
 	for j, f := range nodeCfg.Masters {
@@ -147,7 +147,7 @@ func NewClusterNode(file, name string) (ClusterNode, error) {
 	}
 
 	for j, f := range nodeCfg.FilesystemSlaves {
-		res.fsSlaves[j] = filesystem.NewSlave(":" + f.Port, f.Mnt, nodeCfg.Addr, cfgFullPath, *nodeCfg)
+		res.fsSlaves[j] = filesystem.NewSlave(":" + f.Port, f.Mounts(), name, cfgFullPath, *nodeCfg)
 	}
 
 	return res, nil
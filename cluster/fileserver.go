@@ -4,19 +4,27 @@ import (
 	"HipstMR/fileserver"
 	"flag"
 	"fmt"
+	"strings"
 )
 
 func main() {
 	help := flag.Bool("help", false, "print this help")
 	address := flag.String("address", "", "fileserver adress")
-	mnt := flag.String("mnt", "", "mount dir")
+	mnt := flag.String("mnt", "", "comma separated mount dirs")
+	writable := flag.String("writable", "", "comma separated writable subtrees of mount dir, all of it by default")
+	reserve := flag.Uint64("reserve", 256<<20, "bytes to keep free on every mount dir")
 	flag.Parse()
 	if *help || *address == "" {
 		flag.PrintDefaults()
 		return
 	}
 
-	server := fileserver.NewServer(*address, *mnt)
+	var subtrees []string
+	if *writable != "" {
+		subtrees = strings.Split(*writable, ",")
+	}
+
+	server := fileserver.NewServer(*address, strings.Split(*mnt, ","), subtrees, *reserve)
 	if err := server.Run(); err != nil {
 		fmt.Println("Error:", err)
 	}
@@ -5,13 +5,14 @@ import (
 	"HipstMR/utils"
 	"flag"
 	"fmt"
+	"strings"
 )
 
 func main() {
 	help := flag.Bool("help", false, "print this help")
 	cfgFile := flag.String("config", "", "config file path")
 	address := flag.String("address", "", "fileserver adress")
-	mnt := flag.String("mnt", "", "mount dir")
+	mnt := flag.String("mnt", "", "comma separated mount dirs")
 	name := flag.String("name", "", "machine name")
 	flag.Parse()
 	if *help || *address == "" || *cfgFile == "" || *name == "" {
@@ -29,7 +30,7 @@ func main() {
 		panic("No machine with name \"" + *name + "\".")
 	}
 
-	slave := filesystem.NewSlave(*address, *mnt, *name, *cfgFile, *nodeCfg)
+	slave := filesystem.NewSlave(*address, strings.Split(*mnt, ","), *name, *cfgFile, *nodeCfg)
 	if err := slave.Run(); err != nil {
 		fmt.Println("Error:", err)
 	}
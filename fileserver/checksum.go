@@ -0,0 +1,51 @@
+package fileserver
+
+import (
+	"HipstMR/helper"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Chunks are checked with crc32c, commands carry it in hex in "checksum"
+// param. The check is skipped if there is no such param.
+func formatChecksum(sum uint32) string {
+	return strconv.FormatUint(uint64(sum), 16)
+}
+
+// checkSum compares the checksum with the one expected by the command.
+func checkSum(sum uint32, cmd FileServerCommand) error {
+	str, ok := cmd.Params["checksum"]
+	if !ok || str == "" {
+		return nil
+	}
+
+	expected, err := strconv.ParseUint(str, 16, 32)
+	if err != nil {
+		return errors.New("Bad checksum param: " + str + ".")
+	}
+
+	if uint32(expected) != sum {
+		name := cmd.Params["from"]
+		if name == "" {
+			name = cmd.Params["to"]
+		}
+		err := errors.New("Chunk " + name + " on " + helper.Hostname() + " is corrupted: checksum " +
+			formatChecksum(sum) + " instead of " + str + ".")
+		fmt.Println("Error:", err)
+		return err
+	}
+	return nil
+}
+
+func verifyFile(name string, cmd FileServerCommand) error {
+	if cmd.Params["checksum"] == "" {
+		return nil
+	}
+
+	sum, _, err := helper.FileChecksum(name)
+	if err != nil {
+		return err
+	}
+	return checkSum(sum, cmd)
+}
@@ -1,16 +1,21 @@
 package fileserver
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"path"
 	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"HipstMR/helper"
 	"HipstMR/utils"
 )
 
@@ -21,6 +26,7 @@ type FileServerCommand struct {
 	Action  string            `json:"action"`
 	Params  map[string]string `json:"params"`
 	Payload []byte            `json:"payload"`
+	Length  int64             `json:"length,omitempty"`
 }
 
 func (self *FileServerCommand) Send(conn net.Conn) error {
@@ -32,11 +38,18 @@ func (self *FileServerCommand) Send(conn net.Conn) error {
 }
 
 type Server struct {
-	addr string
-	mnt  string
+	addr     string
+	mnts     []string
+	writable []string
+	reserve  uint64
 }
 
 func (self *Server) Run() (rerr error) {
+	root, err := NewRoot(self.mnts, self.writable, self.reserve)
+	if err != nil {
+		return err
+	}
+
 	sock, err := net.Listen("tcp", self.addr)
 	if err != nil {
 		return err
@@ -57,20 +70,25 @@ func (self *Server) Run() (rerr error) {
 			return err
 		}
 
-		go handle(self.mnt, conn)
+		go handle(root, conn)
 	}
 
 	return nil
 }
 
 func (self *Server) RunProcess(binaryPath string) (string, string, error) {
-	return utils.ExecCmd(exec.Command(path.Clean(binaryPath), "-address", self.addr, "-mnt", self.mnt))
+	return utils.ExecCmd(exec.Command(path.Clean(binaryPath), "-address", self.addr, "-mnt", strings.Join(self.mnts, ","),
+		"-writable", strings.Join(self.writable, ","), "-reserve", strconv.FormatUint(self.reserve, 10)))
 }
 
-func NewServer(addr, mnt string) Server {
+// NewServer serves files of the mount points as a single tree. Writes,
+// which would leave less than reserve bytes free on a mount, are refused.
+func NewServer(addr string, mnts []string, writable []string, reserve uint64) Server {
 	return Server{
-		addr: addr,
-		mnt:  mnt,
+		addr:     addr,
+		mnts:     mnts,
+		writable: writable,
+		reserve:  reserve,
 	}
 }
 
@@ -82,31 +100,46 @@ func tripleErr(err, err1, err2 error) error {
 	return errors.New(fmt.Sprintf("Errors: {%v, %v, %v}", err, err1, err2))
 }
 
-func createFile(to string, data []byte) (rerr error) {
+// createFile writes the body to the file and returns its checksum.
+func createFile(to string, body io.Reader, length int64) (sum uint32, rerr error) {
 	base := path.Dir(to)
 	if err := os.MkdirAll(base, os.ModeDir|os.ModeTemporary|os.ModePerm); err != nil {
-		return err
+		return 0, err
 	}
 
 	out, err := os.Create(to)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	defer func() {
 		cerr := out.Close()
 		if rerr == nil {
 			rerr = cerr
-		} else {
+		} else if cerr != nil {
 			rerr = doubleErr(rerr, cerr)
 		}
+		if rerr != nil {
+			// don't leave partially written files
+			if err := os.Remove(to); err != nil {
+				fmt.Println("Error createFile:", err)
+			}
+		}
 	}()
 
-	if err := utils.WriteAll(out, data); err != nil {
-		return err
+	hash := crc32.New(utils.Castagnoli)
+	n, err := io.Copy(out, io.TeeReader(body, hash))
+	if utils.IsNoSpace(err) {
+		return 0, noSpace(path.Base(to))
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n != length {
+		return 0, io.ErrUnexpectedEOF
 	}
 
-	return nil
+	return hash.Sum32(), nil
 }
 
 func copyFile(from, to string) error {
@@ -128,6 +161,9 @@ func copyFile(from, to string) error {
 	}
 
 	if _, err := io.Copy(out, in); err != nil {
+		if utils.IsNoSpace(err) {
+			err = noSpace(path.Base(to))
+		}
 		if err1 := out.Close(); err1 != nil {
 			return doubleErr(err, err1)
 		}
@@ -137,14 +173,50 @@ func copyFile(from, to string) error {
 	return out.Close()
 }
 
+// missingDir returns the topmost ancestor of the directory, including
+// itself, which doesn't exist, or an empty string.
+func missingDir(dir string) string {
+	res := ""
+	for ; dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		}
+		res = dir
+	}
+	return res
+}
+
+// removeDirs removes the empty directories from dir up to top, it stops
+// at a directory filled by someone else meanwhile.
+func removeDirs(dir, top string) error {
+	for {
+		err := os.Remove(dir)
+		if e, ok := err.(*os.PathError); ok && e.Err == syscall.ENOTEMPTY {
+			return nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if dir == top || dir == "." || dir == "/" {
+			return nil
+		}
+		dir = path.Dir(dir)
+	}
+}
+
 func moveFile(from, to string) error {
 	base := path.Dir(to)
+	created := missingDir(base)
 	if err := os.MkdirAll(base, os.ModeDir|os.ModeTemporary|os.ModePerm); err != nil {
 		return err
 	}
 
 	if err := os.Rename(from, to); err != nil {
-		if err1 := os.RemoveAll(base); err1 != nil {
+		// only the directories made for the move are cleaned up
+		if created == "" {
+			return err
+		}
+		if err1 := removeDirs(base, created); err1 != nil {
 			return doubleErr(err, err1)
 		}
 		return err
@@ -153,34 +225,52 @@ func moveFile(from, to string) error {
 	return nil
 }
 
-func failed(cmd FileServerCommand, conn net.Conn, origErr error) {
+func failed(cmd FileServerCommand, conn *Conn, origErr error) {
 	cmd.Status = "failed"
-	cmd.Params = nil
-	cmd.Payload = nil
-	if err := cmd.Send(conn); err != nil {
+	if _, ok := origErr.(forbiddenError); ok {
+		cmd.Status = "forbidden"
+	} else if _, ok := origErr.(noSpaceError); ok {
+		cmd.Status = "no_space"
+	}
+	cmd.Params = map[string]string{
+		"error": origErr.Error(),
+	}
+	if err := conn.Send(cmd, nil); err != nil {
 		fmt.Printf("Errors failed: {%v, %v}\n", origErr, err)
 	} else {
 		fmt.Println("Error failed:", origErr)
 	}
 }
 
-func send(cmd FileServerCommand, conn net.Conn) {
-	if err := cmd.Send(conn); err != nil {
+func send(cmd FileServerCommand, conn *Conn) {
+	if err := conn.Send(cmd, nil); err != nil {
 		// just can't tell the client about the result
 		fmt.Println("Error send:", err)
 	}
 }
 
-func success(cmd FileServerCommand, conn net.Conn) {
+func success(cmd FileServerCommand, conn *Conn) {
 	cmd.Status = "finished"
 	send(cmd, conn)
 }
 
-func copyLocal(from, to string, cmd FileServerCommand, conn net.Conn) error {
+func copyLocal(from, to string, root *Root, cmd FileServerCommand, conn *Conn) error {
 	if to == from {
 		return nil
 	}
 
+	if err := verifyFile(from, cmd); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+	if err := root.checkSpace(to, info.Size()); err != nil {
+		return err
+	}
+
 	if err := copyFile(from, to); err != nil {
 		return err
 	}
@@ -189,19 +279,39 @@ func copyLocal(from, to string, cmd FileServerCommand, conn net.Conn) error {
 	return nil
 }
 
-func copyRemote(from, to, addr string, cmd FileServerCommand, conn net.Conn) error {
-	file, err := ioutil.ReadFile(from)
+// putRemote streams the file to the fileserver at addr and returns its reply.
+func putRemote(from, to, addr string, cmd FileServerCommand) (FileServerCommand, error) {
+	file, err := os.Open(from)
 	if err != nil {
-		return err
+		return FileServerCommand{}, err
 	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Println("Error putRemote:", err)
+		}
+	}()
 
-	connTo, err := net.Dial("tcp", addr)
+	info, err := file.Stat()
 	if err != nil {
-		return err
+		return FileServerCommand{}, err
+	}
+
+	// the receiver verifies the transfer with the checksum
+	sum, _, err := helper.FileChecksum(from)
+	if err != nil {
+		return FileServerCommand{}, err
+	}
+	if err := checkSum(sum, cmd); err != nil {
+		return FileServerCommand{}, err
+	}
+
+	connTo, err := Dial(addr)
+	if err != nil {
+		return FileServerCommand{}, err
 	}
 	defer func() {
 		if err := connTo.Close(); err != nil {
-			fmt.Println("Error copyRemote:", err)
+			fmt.Println("Error putRemote:", err)
 		}
 	}()
 
@@ -210,16 +320,17 @@ func copyRemote(from, to, addr string, cmd FileServerCommand, conn net.Conn) err
 		Status: "started",
 		Action: "put",
 		Params: map[string]string{
-			"to": to,
+			"to":       to,
+			"checksum": formatChecksum(sum),
 		},
-		Payload: file,
-	}
-	if err := cmdTo.Send(connTo); err != nil {
-		return err
+		Length: info.Size(),
 	}
+	return connTo.Run(cmdTo, file)
+}
 
-	var cmdFrom FileServerCommand
-	if err := json.NewDecoder(bufio.NewReader(connTo)).Decode(&cmdFrom); err != nil {
+func copyRemote(from, to, addr string, cmd FileServerCommand, conn *Conn) error {
+	cmdFrom, err := putRemote(from, to, addr, cmd)
+	if err != nil {
 		return err
 	}
 
@@ -227,25 +338,40 @@ func copyRemote(from, to, addr string, cmd FileServerCommand, conn net.Conn) err
 	return nil
 }
 
-func copy(cmd FileServerCommand, mnt string, conn net.Conn) error {
-	from := path.Clean(path.Join(mnt, cmd.Params["from"]))
+func copy(cmd FileServerCommand, root *Root, conn *Conn) error {
+	from, err := root.Resolve(cmd.Params["from"])
+	if err != nil {
+		return err
+	}
 	to := cmd.Params["to"]
 	if to == "" {
-		to = from
+		to = cmd.Params["from"]
 	}
 	addr, ok := cmd.Params["addr"]
 	if !ok || addr == "" {
-		return copyLocal(from, path.Clean(path.Join(mnt, to)), cmd, conn)
+		to, err := root.ResolveWritableNear(to, from)
+		if err != nil {
+			return err
+		}
+		return copyLocal(from, to, root, cmd, conn)
 	} else {
+		// the remote server checks it too, but don't send it garbage
+		if err := checkName(to); err != nil {
+			return err
+		}
 		return copyRemote(from, to, addr, cmd, conn)
 	}
 }
 
-func moveLocal(from, to string, cmd FileServerCommand, conn net.Conn) error {
+func moveLocal(from, to string, cmd FileServerCommand, conn *Conn) error {
 	if to == from {
 		return nil
 	}
 
+	if err := verifyFile(from, cmd); err != nil {
+		return err
+	}
+
 	if err := moveFile(from, to); err != nil {
 		return err
 	}
@@ -254,69 +380,52 @@ func moveLocal(from, to string, cmd FileServerCommand, conn net.Conn) error {
 	return nil
 }
 
-func moveRemote(from, to, addr string, cmd FileServerCommand, conn net.Conn) error {
-	file, err := ioutil.ReadFile(from)
-	if err != nil {
-		return err
-	}
-
-	connTo, err := net.Dial("tcp", addr)
+func moveRemote(from, to, addr string, cmd FileServerCommand, conn *Conn) error {
+	cmdFrom, err := putRemote(from, to, addr, cmd)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := connTo.Close(); err != nil {
-			fmt.Println("Error copyRemote:", err)
-		}
-	}()
 
-	cmdTo := FileServerCommand{
-		Id:     cmd.Id,
-		Status: "started",
-		Action: "put",
-		Params: map[string]string{
-			"to": to,
-		},
-		Payload: file,
-	}
-	if err := cmdTo.Send(connTo); err != nil {
-		return err
-	}
-
-	decoder := json.NewDecoder(bufio.NewReader(connTo))
-
-	var cmdFrom FileServerCommand
-	if err := decoder.Decode(&cmdFrom); err != nil {
-		return err
-	}
-
-	if cmdFrom.Status != "failed" {
+	if cmdFrom.Status == "finished" {
 		if err := os.Remove(from); err != nil {
 			// we assume, os.Remove never fails, so no fallback on remote server =)
 			fmt.Println("Error moveRemote:", err)
 		}
 	}
 
-	success(cmdFrom, conn)
+	send(cmdFrom, conn)
 	return nil
 }
 
-func move(cmd FileServerCommand, mnt string, conn net.Conn) error {
-	from := path.Clean(path.Join(mnt, cmd.Params["from"]))
+func move(cmd FileServerCommand, root *Root, conn *Conn) error {
+	from, err := root.ResolveWritable(cmd.Params["from"])
+	if err != nil {
+		return err
+	}
 	to := cmd.Params["to"]
 	if to == "" {
-		to = from
+		to = cmd.Params["from"]
 	}
 	addr, ok := cmd.Params["addr"]
 	if !ok || addr == "" {
-		return moveLocal(from, path.Clean(path.Join(mnt, to)), cmd, conn)
+		to, err := root.ResolveWritableNear(to, from)
+		if err != nil {
+			return err
+		}
+		return moveLocal(from, to, cmd, conn)
 	} else {
+		if err := checkName(to); err != nil {
+			return err
+		}
 		return moveRemote(from, to, addr, cmd, conn)
 	}
 }
 
-func del(cmd FileServerCommand, mnt string, conn net.Conn) error {
-	from := path.Clean(path.Join(mnt, cmd.Params["from"]))
+func del(cmd FileServerCommand, root *Root, conn *Conn) error {
+	from, err := root.ResolveWritable(cmd.Params["from"])
+	if err != nil {
+		return err
+	}
 	if err := os.Remove(from); err != nil {
 		return err
 	}
@@ -325,9 +434,23 @@ func del(cmd FileServerCommand, mnt string, conn net.Conn) error {
 	return nil
 }
 
-func put(cmd FileServerCommand, mnt string, conn net.Conn) error {
-	to := path.Clean(path.Join(mnt, cmd.Params["to"]))
-	if err := createFile(to, cmd.Payload); err != nil {
+func put(cmd FileServerCommand, root *Root, conn *Conn) error {
+	to, err := root.ResolveWritable(cmd.Params["to"])
+	if err != nil {
+		return err
+	}
+	if err := root.checkSpace(to, cmd.Length); err != nil {
+		return err
+	}
+	sum, err := createFile(to, conn.Body(), cmd.Length)
+	if err != nil {
+		return err
+	}
+
+	if err := checkSum(sum, cmd); err != nil {
+		if err1 := os.Remove(to); err1 != nil {
+			return doubleErr(err, err1)
+		}
 		return err
 	}
 
@@ -335,47 +458,175 @@ func put(cmd FileServerCommand, mnt string, conn net.Conn) error {
 	return nil
 }
 
-func get(cmd FileServerCommand, mnt string, conn net.Conn) error {
-	from := path.Clean(path.Join(mnt, cmd.Params["from"]))
+func getParam(cmd FileServerCommand, name string, def int64) (int64, error) {
+	str, ok := cmd.Params[name]
+	if !ok || str == "" {
+		return def, nil
+	}
+
+	val, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || val < 0 {
+		return 0, errors.New("Bad " + name + " param: " + str + ".")
+	}
+	return val, nil
+}
+
+// get sends the file or its part starting at offset param of at most
+// length param bytes.
+func get(cmd FileServerCommand, root *Root, conn *Conn) error {
+	from, err := root.Resolve(cmd.Params["from"])
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Println("Error get:", err)
+		}
+	}()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	offset, err := getParam(cmd, "offset", 0)
+	if err != nil {
+		return err
+	}
+	if offset > info.Size() {
+		return errors.New("Offset is out of file.")
+	}
+
+	length, err := getParam(cmd, "length", info.Size()-offset)
+	if err != nil {
+		return err
+	}
+	if length > info.Size()-offset {
+		length = info.Size() - offset
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	cmd.Status = "finished"
+	cmd.Length = length
+	return conn.Send(cmd, file)
+}
+
+// stat replies with size, mtime (unix nanoseconds) and crc32c checksum
+// of the file in params.
+func stat(cmd FileServerCommand, root *Root, conn *Conn) error {
+	from, err := root.Resolve(cmd.Params["from"])
+	if err != nil {
+		return err
+	}
 
-	file, err := ioutil.ReadFile(from)
+	info, err := os.Stat(from)
 	if err != nil {
 		return err
 	}
+	if info.IsDir() {
+		return errors.New(cmd.Params["from"] + " is a directory.")
+	}
 
-	cmd.Payload = file
+	checksum, _, err := helper.FileChecksum(from)
+	if err != nil {
+		return err
+	}
+
+	cmd.Params = map[string]string{
+		"size":     strconv.FormatInt(info.Size(), 10),
+		"mtime":    strconv.FormatInt(info.ModTime().UnixNano(), 10),
+		"checksum": formatChecksum(checksum),
+	}
 	success(cmd, conn)
 	return nil
 }
 
-func onCommand(cmd FileServerCommand, mnt string, conn net.Conn) error {
-	fmt.Println(mnt, "Received " + cmd.Action + " command:", cmd)
+type FileInfo struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	Mtime int64  `json:"mtime"`
+	Dir   bool   `json:"dir"`
+}
+
+// list sends the directory listing as a json array of FileInfo in the body,
+// listings of the directory on all the mounts are merged.
+func list(cmd FileServerCommand, root *Root, conn *Conn) error {
+	dirs, err := root.ResolveAll(cmd.Params["from"])
+	if err != nil {
+		return err
+	}
+
+	// directories are on every mount, files are on one of them
+	res := []FileInfo{}
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, info := range infos {
+			if seen[info.Name()] {
+				continue
+			}
+			seen[info.Name()] = true
+			res = append(res, FileInfo{
+				Name:  info.Name(),
+				Size:  info.Size(),
+				Mtime: info.ModTime().UnixNano(),
+				Dir:   info.IsDir(),
+			})
+		}
+	}
+
+	body, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	cmd.Status = "finished"
+	cmd.Length = int64(len(body))
+	return conn.Send(cmd, bytes.NewReader(body))
+}
+
+func onCommand(cmd FileServerCommand, root *Root, conn *Conn) error {
+	fmt.Println(root.mnts, "Received "+cmd.Action+" command:", cmd.Id, cmd.Params)
 	defer func() {
 		fmt.Println("Done with " + cmd.Action)
 	}()
 	switch cmd.Action {
 	case "get":
-		return get(cmd, mnt, conn)
+		return get(cmd, root, conn)
 	case "put":
-		return put(cmd, mnt, conn)
+		return put(cmd, root, conn)
 	case "copy":
-		return copy(cmd, mnt, conn)
+		return copy(cmd, root, conn)
 	case "move":
-		return move(cmd, mnt, conn)
+		return move(cmd, root, conn)
 	case "del":
-		return del(cmd, mnt, conn)
+		return del(cmd, root, conn)
+	case "stat":
+		return stat(cmd, root, conn)
+	case "list":
+		return list(cmd, root, conn)
 	default:
 		return errors.New("Unknown command " + cmd.Action)
 	}
 }
 
-func doHandle(mnt string, conn net.Conn) error {
-	fmt.Println("Started doHandle", mnt)
-	defer fmt.Println("Done doHandle", mnt)
-	decoder := json.NewDecoder(bufio.NewReader(conn))
+func doHandle(root *Root, conn *Conn) error {
+	fmt.Println("Started doHandle", root.mnts)
+	defer fmt.Println("Done doHandle", root.mnts)
 	for {
-		var cmd FileServerCommand
-		err := decoder.Decode(&cmd)
+		cmd, err := conn.Receive()
 		if err == io.EOF {
 			return nil
 		}
@@ -383,7 +634,15 @@ func doHandle(mnt string, conn net.Conn) error {
 			return err
 		}
 
-		if err := onCommand(cmd, mnt, conn); err != nil {
+		if err := onCommand(cmd, root, conn); err != nil {
+			if _, ok := err.(streamError); ok {
+				return err
+			}
+			// read the rest of a refused body, closing the connection with
+			// unread data resets it before the client gets the reply
+			if err := conn.skipBody(); err != nil {
+				return streamError{err}
+			}
 			failed(cmd, conn, err)
 			return nil
 		}
@@ -391,10 +650,16 @@ func doHandle(mnt string, conn net.Conn) error {
 	return nil
 }
 
-func handle(mnt string, conn net.Conn) {
-	err := doHandle(mnt, conn)
-	if err != nil {
-		failed(FileServerCommand{}, conn, err)
+func handle(root *Root, conn net.Conn) {
+	c, err := acceptConn(conn)
+	if err == nil {
+		err = doHandle(root, c)
+		if _, ok := err.(streamError); err != nil && !ok {
+			failed(FileServerCommand{}, c, err)
+		}
+	}
+	if err != nil && err != io.EOF {
+		fmt.Println("Error handle:", err)
 	}
 
 	if err := conn.Close(); err != nil {
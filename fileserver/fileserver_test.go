@@ -0,0 +1,84 @@
+package fileserver
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// serve handles connections to the root on a local port.
+func serve(t *testing.T, root *Root) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(root, conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestPutRefusalReadsBody(t *testing.T) {
+	root, _ := newTestRoot(t)
+	addr := serve(t, root)
+
+	// larger than the socket buffers, so the server replies before
+	// the client is done sending
+	body := bytes.Repeat([]byte{'x'}, 8<<20)
+	for _, to := range []string{"ro/file", "../outside/new"} {
+		conn, err := Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := conn.Run(FileServerCommand{
+			Id:     "1",
+			Action: "put",
+			Params: map[string]string{"to": to},
+			Length: int64(len(body)),
+		}, bytes.NewReader(body))
+		conn.Close()
+		if err != nil {
+			t.Fatalf("put to %s: %v", to, err)
+		}
+		if res.Status != "forbidden" {
+			t.Errorf("put to %s is %s, want forbidden", to, res.Status)
+		}
+	}
+}
+
+func TestMoveFileKeepsTargetDir(t *testing.T) {
+	root, tmp := newTestRoot(t)
+	data := filepath.Join(tmp, "m1/data")
+
+	// a directory can't replace a file, the rename fails
+	if err := os.Mkdir(filepath.Join(data, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveFile(filepath.Join(data, "dir"), filepath.Join(data, "file")); err == nil {
+		t.Fatal("directory is moved over a file")
+	}
+	if _, err := os.Stat(filepath.Join(data, "both")); err != nil {
+		t.Error("target directory is removed:", err)
+	}
+
+	// directories made for the move are cleaned up
+	if err := moveFile(filepath.Join(data, "missing"), filepath.Join(data, "new/sub/file")); err == nil {
+		t.Fatal("missing file is moved")
+	}
+	if _, err := os.Stat(filepath.Join(data, "new")); !os.IsNotExist(err) {
+		t.Error("made directory is left:", err)
+	}
+	if _, err := root.Resolve("data/file"); err != nil {
+		t.Error("target file is removed:", err)
+	}
+}
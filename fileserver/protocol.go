@@ -0,0 +1,187 @@
+package fileserver
+
+import (
+	"HipstMR/utils"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+)
+
+// Commands travel either as bare JSON objects (the legacy protocol, file
+// contents are base64 encoded in Payload) or as frames: a big endian uint32
+// header size, the JSON header and then Length raw bytes of the body.
+// The server picks the protocol by the first byte of a connection, a frame
+// can't start with '{' since headers are limited by maxHeader.
+const maxHeader = 1 << 20
+
+// streamError means the connection is out of sync and must be closed
+// without a reply.
+type streamError struct {
+	error
+}
+
+type Conn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	decoder *json.Decoder
+	framed  bool
+	body    *io.LimitedReader
+}
+
+// Receive reads the next command. Its body is available through Body
+// until the next call.
+func (self *Conn) Receive() (FileServerCommand, error) {
+	var cmd FileServerCommand
+	if err := self.skipBody(); err != nil {
+		return cmd, err
+	}
+
+	if !self.framed {
+		if err := self.decoder.Decode(&cmd); err != nil {
+			return cmd, err
+		}
+		cmd.Length = int64(len(cmd.Payload))
+		self.body = &io.LimitedReader{R: bytes.NewReader(cmd.Payload), N: cmd.Length}
+		return cmd, nil
+	}
+
+	var size uint32
+	if err := binary.Read(self.reader, binary.BigEndian, &size); err != nil {
+		return cmd, err
+	}
+	if size > maxHeader {
+		return cmd, errors.New("Too large command header.")
+	}
+
+	header := make([]byte, size)
+	if _, err := io.ReadFull(self.reader, header); err != nil {
+		return cmd, err
+	}
+	if err := json.Unmarshal(header, &cmd); err != nil {
+		return cmd, err
+	}
+	if cmd.Length < 0 {
+		return cmd, errors.New("Negative body length.")
+	}
+
+	self.body = &io.LimitedReader{R: self.reader, N: cmd.Length}
+	return cmd, nil
+}
+
+// Body returns the body of the last received command.
+func (self *Conn) Body() io.Reader {
+	if self.body == nil {
+		return bytes.NewReader(nil)
+	}
+	return self.body
+}
+
+func (self *Conn) skipBody() error {
+	if self.body == nil {
+		return nil
+	}
+
+	body := self.body
+	self.body = nil
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return err
+	}
+	if body.N > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// Send writes the command followed by cmd.Length bytes read from body.
+func (self *Conn) Send(cmd FileServerCommand, body io.Reader) error {
+	if body == nil {
+		cmd.Length = 0
+	}
+
+	if !self.framed {
+		cmd.Payload = nil
+		if cmd.Length > 0 {
+			cmd.Payload = make([]byte, cmd.Length)
+			if _, err := io.ReadFull(body, cmd.Payload); err != nil {
+				return err
+			}
+		}
+		cmd.Length = 0
+		return cmd.Send(self.conn)
+	}
+
+	cmd.Payload = nil
+	header, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4, 4+len(header))
+	binary.BigEndian.PutUint32(buf, uint32(len(header)))
+	if err := utils.WriteAll(self.conn, append(buf, header...)); err != nil {
+		return err
+	}
+
+	if cmd.Length > 0 {
+		if _, err := io.CopyN(self.conn, body, cmd.Length); err != nil {
+			return streamError{err}
+		}
+	}
+	return nil
+}
+
+// Run sends the command and waits for the reply, the reply body
+// is available through Body.
+func (self *Conn) Run(cmd FileServerCommand, body io.Reader) (FileServerCommand, error) {
+	if err := self.Send(cmd, body); err != nil {
+		return FileServerCommand{}, err
+	}
+	return self.Receive()
+}
+
+func (self *Conn) Close() error {
+	return self.conn.Close()
+}
+
+// NewConn wraps a client connection, clients always speak framed protocol.
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		framed: true,
+	}
+}
+
+func Dial(addr string) (*Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn), nil
+}
+
+// acceptConn detects the protocol the client speaks.
+func acceptConn(conn net.Conn) (*Conn, error) {
+	res := &Conn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+
+	first, err := res.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch first[0] {
+	case '{', ' ', '\t', '\r', '\n':
+		res.decoder = json.NewDecoder(res.reader)
+	default:
+		res.framed = true
+	}
+	return res, nil
+}
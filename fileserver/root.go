@@ -0,0 +1,249 @@
+package fileserver
+
+import (
+	"HipstMR/utils"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// forbiddenError is reported to clients with "forbidden" status.
+type forbiddenError struct {
+	error
+}
+
+func forbidden(name string) error {
+	return forbiddenError{errors.New("Access to " + name + " is forbidden.")}
+}
+
+// noSpaceError is reported to clients with "no_space" status.
+type noSpaceError struct {
+	error
+}
+
+func noSpace(name string) error {
+	return noSpaceError{errors.New("No space left for " + name + ".")}
+}
+
+// Root confines requests to the mount points. Only writable subtrees
+// of them may be changed, the whole mounts are writable if there are none.
+// A name is looked up on every mount, new files are put on the mount with
+// the most free space. Reserve bytes are kept free on every mount.
+type Root struct {
+	mnts     []string
+	writable []string
+	reserve  uint64
+}
+
+// checkName rejects names which are not relative to the mount.
+func checkName(name string) error {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return forbidden(name)
+	}
+	return nil
+}
+
+func within(root, name string) bool {
+	return root == "/" || name == root || strings.HasPrefix(name, root+"/")
+}
+
+// evalSymlinks resolves symlinks in the existing part of the path,
+// the rest of it is appended as is.
+func evalSymlinks(name string) (string, error) {
+	rest := ""
+	for {
+		real, err := filepath.EvalSymlinks(name)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if _, err := os.Lstat(name); err == nil {
+			// dangling symlink, it may point anywhere once created
+			return "", forbidden(name)
+		}
+
+		parent := filepath.Dir(name)
+		if parent == name {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(name), rest)
+		name = parent
+	}
+}
+
+// resolveIn returns the real path of the name under the mount.
+func resolveIn(mnt, name string) (string, error) {
+	res, err := evalSymlinks(filepath.Join(mnt, name))
+	if _, ok := err.(forbiddenError); ok {
+		return "", forbidden(name)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !within(mnt, res) {
+		return "", forbidden(name)
+	}
+	return res, nil
+}
+
+// placement returns the mount with the most free space, failed disks
+// are skipped.
+func (self *Root) placement() string {
+	res, _, err := utils.MostAvailable(self.mnts, self.reserve)
+	if err != nil {
+		return self.mnts[0]
+	}
+	return res
+}
+
+// mountOf returns the mount the real path is on.
+func (self *Root) mountOf(name string) string {
+	for _, mnt := range self.mnts {
+		if within(mnt, name) {
+			return mnt
+		}
+	}
+	return self.mnts[0]
+}
+
+// Resolve returns the real path of the name on the mount it exists on,
+// or on the mount for new files.
+func (self *Root) Resolve(name string) (string, error) {
+	return self.resolveNear(name, "")
+}
+
+// resolveNear puts new files on the same mount as near, so they can be
+// renamed there.
+func (self *Root) resolveNear(name, near string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+
+	for _, mnt := range self.mnts {
+		res, err := resolveIn(mnt, name)
+		if _, ok := err.(forbiddenError); ok {
+			return "", err
+		}
+		if err != nil {
+			// a failed disk, the name is looked up on the others
+			continue
+		}
+		if _, err := os.Lstat(res); err == nil {
+			return res, nil
+		}
+	}
+
+	if near != "" {
+		return resolveIn(self.mountOf(near), name)
+	}
+	return resolveIn(self.placement(), name)
+}
+
+// ResolveAll returns real paths of the name on every mount it exists on.
+func (self *Root) ResolveAll(name string) ([]string, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
+	res := []string{}
+	for _, mnt := range self.mnts {
+		p, err := resolveIn(mnt, name)
+		if _, ok := err.(forbiddenError); ok {
+			return nil, err
+		}
+		if err != nil {
+			continue
+		}
+		if _, err := os.Lstat(p); err == nil {
+			res = append(res, p)
+		}
+	}
+	if len(res) == 0 {
+		return nil, errors.New(name + " doesn't exist.")
+	}
+	return res, nil
+}
+
+// checkSpace fails if writing length bytes to the real path would leave
+// less than the reserve free on its mount.
+func (self *Root) checkSpace(name string, length int64) error {
+	free, err := utils.FreeSpace(self.mountOf(name))
+	if err != nil {
+		return err
+	}
+	if length < 0 || free < uint64(length)+self.reserve {
+		return noSpace(filepath.Base(name))
+	}
+	return nil
+}
+
+// ResolveWritable is Resolve for names which are going to be changed.
+func (self *Root) ResolveWritable(name string) (string, error) {
+	return self.ResolveWritableNear(name, "")
+}
+
+func (self *Root) ResolveWritableNear(name, near string) (string, error) {
+	res, err := self.resolveNear(name, near)
+	if err != nil {
+		return "", err
+	}
+
+	for _, mnt := range self.mnts {
+		if res == mnt {
+			return "", forbidden(name)
+		}
+	}
+	if len(self.writable) == 0 {
+		return res, nil
+	}
+	for _, w := range self.writable {
+		if within(w, res) {
+			return res, nil
+		}
+	}
+	return "", forbidden(name)
+}
+
+func NewRoot(mnts []string, writable []string, reserve uint64) (*Root, error) {
+	if len(mnts) == 0 {
+		return nil, errors.New("No mount points.")
+	}
+
+	res := &Root{
+		mnts:     make([]string, 0, len(mnts)),
+		writable: make([]string, 0, len(writable)*len(mnts)),
+		reserve:  reserve,
+	}
+	for _, mnt := range mnts {
+		abs, err := filepath.Abs(mnt)
+		if err != nil {
+			return nil, err
+		}
+
+		real, err := filepath.EvalSymlinks(abs)
+		if err != nil {
+			return nil, err
+		}
+		res.mnts = append(res.mnts, real)
+	}
+
+	for _, w := range writable {
+		if err := checkName(w); err != nil {
+			return nil, err
+		}
+		for _, mnt := range res.mnts {
+			p, err := resolveIn(mnt, w)
+			if err != nil {
+				return nil, err
+			}
+			res.writable = append(res.writable, p)
+		}
+	}
+	return res, nil
+}
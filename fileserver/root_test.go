@@ -0,0 +1,160 @@
+package fileserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestRoot makes two mounts with a writable "data" subtree and
+// a directory outside of them:
+//
+//	m1/data/file, m1/data/both, m1/ro/file
+//	m1/escape -> outside, m1/dangling -> outside/new, m1/inner -> m1/data
+//	m2/data/only2, m2/data/both, m2/data/cross -> m1/data/file
+func newTestRoot(t *testing.T) (*Root, string) {
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirs := []string{"m1/data", "m1/ro", "m2/data", "outside"}
+	for _, d := range dirs {
+		if err := os.MkdirAll(filepath.Join(tmp, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []string{"m1/data/file", "m1/data/both", "m1/ro/file", "m2/data/only2", "m2/data/both", "outside/secret"}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(tmp, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"m1/escape":     filepath.Join(tmp, "outside"),
+		"m1/dangling":   filepath.Join(tmp, "outside/new"),
+		"m1/inner":      "data",
+		"m2/data/cross": filepath.Join(tmp, "m1/data/file"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(tmp, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root, err := NewRoot([]string{filepath.Join(tmp, "m1"), filepath.Join(tmp, "m2")}, []string{"data"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root, tmp
+}
+
+func TestRootResolve(t *testing.T) {
+	root, tmp := newTestRoot(t)
+
+	tests := []struct {
+		name     string
+		writable bool
+		// the real path relative to the temporary directory,
+		// empty if access is forbidden
+		want string
+	}{
+		{"../outside/secret", false, ""},
+		{"data/../../outside/secret", false, ""},
+		{"..", false, ""},
+		{"/etc/passwd", false, ""},
+		{"/", false, ""},
+		{"escape/secret", false, ""},
+		{"escape", false, ""},
+		{"dangling", false, ""},
+		{"dangling", true, ""},
+		{"data/cross", false, ""},
+		{"inner/file", false, "m1/data/file"},
+		{"data/file", false, "m1/data/file"},
+		{"data/./file", false, "m1/data/file"},
+		{"data/only2", false, "m2/data/only2"},
+		{"ro/file", false, "m1/ro/file"},
+		{"", false, "m1"},
+		{".", false, "m1"},
+		{"", true, ""},
+		{".", true, ""},
+		{"data/..", true, ""},
+		{"ro/file", true, ""},
+		{"ro/new", true, ""},
+		{"escape/new", true, ""},
+		{"data/file", true, "m1/data/file"},
+		{"data/only2", true, "m2/data/only2"},
+		{"inner/file", true, "m1/data/file"},
+	}
+
+	for _, test := range tests {
+		var res string
+		var err error
+		if test.writable {
+			res, err = root.ResolveWritable(test.name)
+		} else {
+			res, err = root.Resolve(test.name)
+		}
+
+		if test.want == "" {
+			if _, ok := err.(forbiddenError); !ok {
+				t.Errorf("%q (writable %v): got %q, %v, want forbidden", test.name, test.writable, res, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q (writable %v): %v", test.name, test.writable, err)
+			continue
+		}
+		if want := filepath.Join(tmp, test.want); res != want {
+			t.Errorf("%q (writable %v): got %q, want %q", test.name, test.writable, res, want)
+		}
+	}
+}
+
+func TestRootMounts(t *testing.T) {
+	root, tmp := newTestRoot(t)
+
+	all, err := root.ResolveAll("data/both")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0] != filepath.Join(tmp, "m1/data/both") || all[1] != filepath.Join(tmp, "m2/data/both") {
+		t.Errorf("data/both is resolved to %v on both mounts", all)
+	}
+	if _, err := root.ResolveAll("data/missing"); err == nil {
+		t.Error("missing name is resolved")
+	}
+	if _, err := root.ResolveAll("escape/secret"); err == nil {
+		t.Error("symlink escape is resolved")
+	}
+
+	// new files are put near the given path, so they can be renamed there
+	near := filepath.Join(tmp, "m2/data/only2")
+	res, err := root.ResolveWritableNear("data/new", near)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(tmp, "m2/data/new"); res != want {
+		t.Errorf("data/new near %q is resolved to %q, want %q", near, res, want)
+	}
+
+	// new files go to one of the mounts
+	res, err = root.ResolveWritable("data/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != filepath.Join(tmp, "m1/data/new") && res != filepath.Join(tmp, "m2/data/new") {
+		t.Errorf("data/new is resolved to %q", res)
+	}
+}
+
+func TestNewRootRejectsWritableOutside(t *testing.T) {
+	_, tmp := newTestRoot(t)
+	for _, w := range []string{"..", "../outside", "/tmp", "escape"} {
+		if _, err := NewRoot([]string{filepath.Join(tmp, "m1")}, []string{w}, 0); err == nil {
+			t.Errorf("writable subtree %q is accepted", w)
+		}
+	}
+}
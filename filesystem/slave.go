@@ -10,6 +10,7 @@ import (
 	"HipstMR/utils"
 	"encoding/json"
 	"io"
+	"strings"
 )
 
 type FileNumCfg struct {
@@ -52,7 +53,7 @@ type FileInfo struct {
 
 type Slave struct {
 	addr string
-	mnt  string
+	mnts []string
 	name string
 	cfgPath string
 	cfg utils.MachineCfg
@@ -86,7 +87,7 @@ func (self *Slave) Run() (rerr error) {
 }
 
 func (self *Slave) RunProcess(binaryPath string) (string, string, error) {
-	return utils.ExecCmd(exec.Command(path.Clean(binaryPath), "-address", self.addr, "-mnt", self.mnt, "-name", self.name, "-config", self.cfgPath))
+	return utils.ExecCmd(exec.Command(path.Clean(binaryPath), "-address", self.addr, "-mnt", strings.Join(self.mnts, ","), "-name", self.name, "-config", self.cfgPath))
 }
 
 func (self *Slave) put(cmd FileSystemCommand, conn net.Conn) error {
@@ -127,10 +128,10 @@ func (self *Slave) handle(conn net.Conn) {
 	}
 }
 
-func NewSlave(addr, mnt, name, cfgPath string, cfg utils.MachineCfg) Slave {
+func NewSlave(addr string, mnts []string, name, cfgPath string, cfg utils.MachineCfg) Slave {
 	return Slave{
 		addr: addr,
-		mnt:  mnt,
+		mnts: mnts,
 		name: name,
 		cfgPath: cfgPath,
 		cfg: cfg,
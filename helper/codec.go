@@ -0,0 +1,334 @@
+package helper
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// snapshotMagic starts binary .fsdat files, old ones are JSON.
+// Version 1 snapshots have no chunk checksums, version 2 ones have
+// no expiration times of tables and version 3 ones have no disks
+// of chunks. The last byte is the version.
+const (
+	snapshotMagic   = "HMRFSD\x00\x04"
+	snapshotMagicV1 = "HMRFSD\x00\x01"
+	snapshotMagicV2 = "HMRFSD\x00\x02"
+	snapshotMagicV3 = "HMRFSD\x00\x03"
+)
+
+// withChecksum is set in the op byte of mutations followed by a checksum.
+const withChecksum = 0x80
+
+// maxString limits lengths read from binary metadata, so garbage in a
+// corrupted file can't cause a huge allocation.
+const maxString = 1 << 16
+
+var mutationOps = []string{"", "add_chunk", "del_chunk", "add_tag", "del_tag", "del_num", "set_expire", "set_disk"}
+
+// Batch is a group of mutations committed at once.
+type Batch struct {
+	Seq       uint64
+	Mutations []Mutation
+}
+
+// Delta is what the master needs to update its copy of slave's metadata.
+type Delta struct {
+	Full      bool
+	From      uint64
+	To        uint64
+	Mutations []Mutation
+	Chunks    map[string]*ChunkData
+	Expires   map[string]int64
+}
+
+type binWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (self *binWriter) raw(bs []byte) {
+	if self.err != nil {
+		return
+	}
+	_, self.err = self.w.Write(bs)
+}
+
+func (self *binWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(self.buf[:], v)
+	self.raw(self.buf[:n])
+}
+
+func (self *binWriter) str(s string) {
+	self.uvarint(uint64(len(s)))
+	self.raw([]byte(s))
+}
+
+func (self *binWriter) flush() error {
+	if self.err != nil {
+		return self.err
+	}
+	return self.w.Flush()
+}
+
+func newBinWriter(w io.Writer) *binWriter {
+	return &binWriter{
+		w: bufio.NewWriter(w),
+	}
+}
+
+type binReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (self *binReader) uvarint() uint64 {
+	if self.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(self.r)
+	if err != nil {
+		self.err = err
+	}
+	return v
+}
+
+func (self *binReader) str() string {
+	l := self.uvarint()
+	if self.err != nil {
+		return ""
+	}
+	if l > maxString {
+		self.err = errors.New("Corrupted metadata: string is too long.")
+		return ""
+	}
+
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(self.r, buf); err != nil {
+		self.err = err
+		return ""
+	}
+	return string(buf)
+}
+
+func (self *binReader) byte() byte {
+	if self.err != nil {
+		return 0
+	}
+	b, err := self.r.ReadByte()
+	if err != nil {
+		self.err = err
+	}
+	return b
+}
+
+func newBinReader(r io.Reader) *binReader {
+	return &binReader{
+		r: bufio.NewReader(r),
+	}
+}
+
+func writeChunks(w *binWriter, chunks map[string]*ChunkData) {
+	w.uvarint(uint64(len(chunks)))
+	for k, v := range chunks {
+		w.str(k)
+		w.uvarint(v.Size)
+		w.uvarint(uint64(v.Checksum))
+		w.str(v.Disk)
+		w.uvarint(uint64(len(v.Tags)))
+		for tag, nums := range v.Tags {
+			w.str(tag)
+			w.uvarint(uint64(len(nums)))
+			for _, n := range nums {
+				w.uvarint(n)
+			}
+		}
+	}
+}
+
+func readChunks(r *binReader, checksums, disks bool) map[string]*ChunkData {
+	cnt := r.uvarint()
+	res := make(map[string]*ChunkData)
+	for i := uint64(0); i < cnt && r.err == nil; i++ {
+		id := r.str()
+		data := &ChunkData{
+			Size: r.uvarint(),
+			Tags: make(TagsSet),
+		}
+		if checksums {
+			data.Checksum = uint32(r.uvarint())
+		}
+		if disks {
+			data.Disk = r.str()
+		}
+
+		tags := r.uvarint()
+		for j := uint64(0); j < tags && r.err == nil; j++ {
+			tag := r.str()
+			nums := r.uvarint()
+			for n := uint64(0); n < nums && r.err == nil; n++ {
+				data.Tags[tag] = append(data.Tags[tag], r.uvarint())
+			}
+		}
+		res[id] = data
+	}
+	return res
+}
+
+func writeExpires(w *binWriter, expires map[string]int64) {
+	w.uvarint(uint64(len(expires)))
+	for k, v := range expires {
+		w.str(k)
+		w.uvarint(uint64(v))
+	}
+}
+
+func readExpires(r *binReader) map[string]int64 {
+	cnt := r.uvarint()
+	res := make(map[string]int64)
+	for i := uint64(0); i < cnt && r.err == nil; i++ {
+		k := r.str()
+		res[k] = int64(r.uvarint())
+	}
+	return res
+}
+
+func writeMutations(w *binWriter, batch []Mutation) {
+	w.uvarint(uint64(len(batch)))
+	for _, m := range batch {
+		op := 0
+		for i, v := range mutationOps {
+			if v == m.Op {
+				op = i
+			}
+		}
+		if m.Checksum != 0 {
+			op |= withChecksum
+		}
+		w.raw([]byte{byte(op)})
+		w.str(m.Chunk)
+		w.str(m.Tag)
+		w.uvarint(m.Num)
+		w.uvarint(m.Size)
+		if m.Checksum != 0 {
+			w.uvarint(uint64(m.Checksum))
+		}
+	}
+}
+
+func readMutations(r *binReader) []Mutation {
+	cnt := r.uvarint()
+	res := []Mutation{}
+	for i := uint64(0); i < cnt && r.err == nil; i++ {
+		op := int(r.byte())
+		flags := op & withChecksum
+		op &^= withChecksum
+		if op == 0 || op >= len(mutationOps) {
+			if r.err == nil {
+				r.err = errors.New("Corrupted metadata: unknown mutation.")
+			}
+			break
+		}
+
+		m := Mutation{
+			Op:    mutationOps[op],
+			Chunk: r.str(),
+			Tag:   r.str(),
+			Num:   r.uvarint(),
+			Size:  r.uvarint(),
+		}
+		if flags&withChecksum != 0 {
+			m.Checksum = uint32(r.uvarint())
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+func isBinarySnapshot(bs []byte) bool {
+	return bytes.HasPrefix(bs, []byte(snapshotMagic)) || bytes.HasPrefix(bs, []byte(snapshotMagicV1)) ||
+		bytes.HasPrefix(bs, []byte(snapshotMagicV2)) || bytes.HasPrefix(bs, []byte(snapshotMagicV3))
+}
+
+func encodeSnapshot(chunks map[string]*ChunkData, expires map[string]int64, seq uint64) []byte {
+	var buf bytes.Buffer
+	w := newBinWriter(&buf)
+	w.raw([]byte(snapshotMagic))
+	w.uvarint(seq)
+	writeChunks(w, chunks)
+	writeExpires(w, expires)
+	w.flush()
+	return buf.Bytes()
+}
+
+func decodeSnapshot(bs []byte) (map[string]*ChunkData, map[string]int64, uint64, error) {
+	version := bs[len(snapshotMagic)-1]
+	r := newBinReader(bytes.NewReader(bs[len(snapshotMagic):]))
+	seq := r.uvarint()
+	chunks := readChunks(r, version >= 2, version >= 4)
+	expires := map[string]int64{}
+	if version >= 3 {
+		expires = readExpires(r)
+	}
+	if r.err != nil {
+		return nil, nil, 0, r.err
+	}
+	return chunks, expires, seq, nil
+}
+
+func (self *Batch) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	w := newBinWriter(&buf)
+	w.uvarint(self.Seq)
+	writeMutations(w, self.Mutations)
+	if err := w.flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (self *Batch) UnmarshalBinary(bs []byte) error {
+	r := newBinReader(bytes.NewReader(bs))
+	self.Seq = r.uvarint()
+	self.Mutations = readMutations(r)
+	return r.err
+}
+
+func (self *Delta) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	w := newBinWriter(&buf)
+	if self.Full {
+		w.raw([]byte{1})
+	} else {
+		w.raw([]byte{0})
+	}
+	w.uvarint(self.From)
+	w.uvarint(self.To)
+	if self.Full {
+		writeChunks(w, self.Chunks)
+		writeExpires(w, self.Expires)
+	} else {
+		writeMutations(w, self.Mutations)
+	}
+	if err := w.flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (self *Delta) UnmarshalBinary(bs []byte) error {
+	r := newBinReader(bytes.NewReader(bs))
+	self.Full = r.byte() == 1
+	self.From = r.uvarint()
+	self.To = r.uvarint()
+	if self.Full {
+		self.Chunks = readChunks(r, true, true)
+		self.Expires = readExpires(r)
+	} else {
+		self.Mutations = readMutations(r)
+	}
+	return r.err
+}
@@ -3,9 +3,11 @@ package helper
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strings"
 )
 
@@ -42,17 +44,419 @@ func (self *TagsSet) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// ChunkData describes a chunk stored by a slave. Disk is the mount point
+// of the slave the chunk file lives on.
 type ChunkData struct {
-	Size uint64  `json:"size"`
-	Tags TagsSet `json:"tags"`
+	Size     uint64  `json:"size"`
+	Checksum uint32  `json:"checksum"`
+	Tags     TagsSet `json:"tags"`
+	Disk     string  `json:"disk"`
 }
 
+// compactBatches is the number of journal batches, after which
+// the snapshot is rewritten and the journal is truncated.
+const compactBatches = 1024
+
+// maxHistory is the number of last batches kept in memory to send deltas.
+const maxHistory = 4096
+
+// Expires keeps expiration times of tables as unix seconds.
 type FsData struct {
-	Chunks map[string]*ChunkData `json:"chunks"`
+	Chunks  map[string]*ChunkData `json:"chunks"`
+	Expires map[string]int64      `json:"expires"`
+	Seq     uint64                `json:"seq"`
+	index   map[string]map[string]bool
+	log     []Mutation
+	undo    [][]Mutation
+	history []Batch
+	base    uint64
+}
+
+func (self *FsData) init() {
+	if self.Chunks == nil {
+		self.Chunks = make(map[string]*ChunkData)
+	}
+	if self.Expires == nil {
+		self.Expires = make(map[string]int64)
+	}
+	if self.index == nil {
+		self.reindex()
+	}
+}
+
+func (self *FsData) reindex() {
+	self.index = make(map[string]map[string]bool)
+	for k, v := range self.Chunks {
+		for tag, _ := range v.Tags {
+			self.indexAdd(tag, k)
+		}
+	}
+}
+
+func (self *FsData) indexAdd(tag, chunk string) {
+	chunks, ok := self.index[tag]
+	if !ok {
+		chunks = make(map[string]bool)
+		self.index[tag] = chunks
+	}
+	chunks[chunk] = true
+}
+
+func (self *FsData) indexDel(tag, chunk string) {
+	chunks, ok := self.index[tag]
+	if !ok {
+		return
+	}
+	delete(chunks, chunk)
+	if len(chunks) == 0 {
+		delete(self.index, tag)
+	}
+}
+
+func (self *FsData) apply(m Mutation) {
+	self.init()
+	switch m.Op {
+	case "add_chunk":
+		// the tag of the mutation is the disk of the chunk
+		if _, ok := self.Chunks[m.Chunk]; !ok {
+			self.Chunks[m.Chunk] = &ChunkData{
+				Size:     m.Size,
+				Checksum: m.Checksum,
+				Tags:     make(TagsSet),
+				Disk:     m.Tag,
+			}
+		}
+	case "set_disk":
+		if ch, ok := self.Chunks[m.Chunk]; ok {
+			ch.Disk = m.Tag
+		}
+	case "del_chunk":
+		ch, ok := self.Chunks[m.Chunk]
+		if !ok {
+			return
+		}
+		for tag, _ := range ch.Tags {
+			self.indexDel(tag, m.Chunk)
+		}
+		delete(self.Chunks, m.Chunk)
+	case "add_tag":
+		ch, ok := self.Chunks[m.Chunk]
+		if !ok {
+			return
+		}
+		for _, n := range ch.Tags[m.Tag] {
+			if n == m.Num {
+				return
+			}
+		}
+		ch.Tags[m.Tag] = append(ch.Tags[m.Tag], m.Num)
+		self.indexAdd(m.Tag, m.Chunk)
+	case "del_tag":
+		ch, ok := self.Chunks[m.Chunk]
+		if ok {
+			delete(ch.Tags, m.Tag)
+			self.indexDel(m.Tag, m.Chunk)
+		}
+	case "del_num":
+		ch, ok := self.Chunks[m.Chunk]
+		if !ok {
+			return
+		}
+		nums := ch.Tags[m.Tag]
+		for i, n := range nums {
+			if n == m.Num {
+				nums = append(nums[:i:i], nums[i+1:]...)
+				break
+			}
+		}
+		if len(nums) == 0 {
+			delete(ch.Tags, m.Tag)
+			self.indexDel(m.Tag, m.Chunk)
+		} else {
+			ch.Tags[m.Tag] = nums
+		}
+	case "set_expire":
+		if m.Num == 0 {
+			delete(self.Expires, m.Tag)
+		} else {
+			self.Expires[m.Tag] = int64(m.Num)
+		}
+	}
+}
+
+// inverse returns mutations, which revert the mutation in the current state.
+func (self *FsData) inverse(m Mutation) []Mutation {
+	ch, ok := self.Chunks[m.Chunk]
+	switch m.Op {
+	case "add_chunk":
+		if !ok {
+			return []Mutation{{Op: "del_chunk", Chunk: m.Chunk}}
+		}
+	case "del_chunk":
+		if ok {
+			res := []Mutation{{Op: "add_chunk", Chunk: m.Chunk, Tag: ch.Disk, Size: ch.Size, Checksum: ch.Checksum}}
+			for tag, nums := range ch.Tags {
+				for _, n := range nums {
+					res = append(res, Mutation{Op: "add_tag", Chunk: m.Chunk, Tag: tag, Num: n})
+				}
+			}
+			return res
+		}
+	case "add_tag":
+		if ok {
+			for _, n := range ch.Tags[m.Tag] {
+				if n == m.Num {
+					return nil
+				}
+			}
+			return []Mutation{{Op: "del_num", Chunk: m.Chunk, Tag: m.Tag, Num: m.Num}}
+		}
+	case "del_tag", "del_num":
+		if ok {
+			res := []Mutation{}
+			for _, n := range ch.Tags[m.Tag] {
+				if m.Op == "del_tag" || n == m.Num {
+					res = append(res, Mutation{Op: "add_tag", Chunk: m.Chunk, Tag: m.Tag, Num: n})
+				}
+			}
+			return res
+		}
+	case "set_disk":
+		if ok {
+			return []Mutation{{Op: "set_disk", Chunk: m.Chunk, Tag: ch.Disk}}
+		}
+	case "set_expire":
+		return []Mutation{{Op: "set_expire", Tag: m.Tag, Num: uint64(self.Expires[m.Tag])}}
+	}
+	return nil
+}
+
+func (self *FsData) mutate(m Mutation) {
+	self.init()
+	self.undo = append(self.undo, self.inverse(m))
+	self.apply(m)
+	self.log = append(self.log, m)
+}
+
+func (self *FsData) AddChunk(id, disk string, size uint64, checksum uint32) {
+	self.mutate(Mutation{Op: "add_chunk", Chunk: id, Tag: disk, Size: size, Checksum: checksum})
+}
+
+// SetDisk records the chunk file was found on another disk.
+func (self *FsData) SetDisk(id, disk string) {
+	self.mutate(Mutation{Op: "set_disk", Chunk: id, Tag: disk})
+}
+
+func (self *FsData) DelChunk(id string) {
+	self.mutate(Mutation{Op: "del_chunk", Chunk: id})
+}
+
+func (self *FsData) AddTag(id, tag string, num uint64) {
+	self.mutate(Mutation{Op: "add_tag", Chunk: id, Tag: tag, Num: num})
+}
+
+func (self *FsData) DelTag(id, tag string) {
+	self.mutate(Mutation{Op: "del_tag", Chunk: id, Tag: tag})
+}
+
+// SetExpire sets the expiration time of the table, zero removes it.
+func (self *FsData) SetExpire(tag string, expires int64) {
+	self.mutate(Mutation{Op: "set_expire", Tag: tag, Num: uint64(expires)})
+}
+
+// Mutate applies mutations, made elsewhere, as if they were made here.
+func (self *FsData) Mutate(batch []Mutation) {
+	for _, m := range batch {
+		self.mutate(m)
+	}
+}
+
+// Mark returns the position in the pending mutations for Undo.
+func (self *FsData) Mark() int {
+	return len(self.log)
+}
+
+// Undo reverts all the pending mutations made after the mark.
+func (self *FsData) Undo(mark int) {
+	for i := len(self.log) - 1; i >= mark; i-- {
+		for j := len(self.undo[i]) - 1; j >= 0; j-- {
+			self.apply(self.undo[i][j])
+		}
+	}
+	self.log = self.log[:mark]
+	self.undo = self.undo[:mark]
+}
+
+// Pending returns mutations made since the last commit.
+func (self *FsData) Pending() []Mutation {
+	return self.log
+}
+
+// Tags returns names of all the tables.
+func (self *FsData) Tags() []string {
+	self.init()
+	res := make([]string, 0, len(self.index))
+	for tag, _ := range self.index {
+		res = append(res, tag)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// TagChunks returns chunks of the table in the order of their numbers.
+func (self *FsData) TagChunks(tag string) []string {
+	self.init()
+	res := make([]string, 0, len(self.index[tag]))
+	for k, _ := range self.index[tag] {
+		res = append(res, k)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		ni := minNum(self.Chunks[res[i]].Tags[tag])
+		nj := minNum(self.Chunks[res[j]].Tags[tag])
+		if ni != nj {
+			return ni < nj
+		}
+		return res[i] < res[j]
+	})
+	return res
+}
+
+func minNum(nums []uint64) uint64 {
+	var res uint64 = 0
+	for i, n := range nums {
+		if i == 0 || n < res {
+			res = n
+		}
+	}
+	return res
+}
+
+// Commit durably stores pending mutations as a single batch appended to the
+// journal. The snapshot is rewritten only once in a while, so a commit costs
+// the size of the batch rather than the size of the whole metadata.
+func (self *FsData) Commit(file string, journal *Journal) error {
+	if len(self.log) == 0 {
+		return nil
+	}
+
+	batch := Batch{
+		Seq:       self.Seq + 1,
+		Mutations: self.log,
+	}
+	if err := journal.Append(batch); err != nil {
+		return err
+	}
+
+	self.Seq = batch.Seq
+	self.addHistory(batch)
+	self.log = nil
+	self.undo = nil
+
+	if journal.Count() < compactBatches {
+		return nil
+	}
+
+	// the batch is durable already, failed compaction is retried
+	// on the next commit
+	if err := self.Write(file); err != nil {
+		fmt.Println("Error compaction:", err)
+	} else if err := journal.Truncate(); err != nil {
+		fmt.Println("Error compaction:", err)
+	}
+	return nil
+}
+
+func (self *FsData) addHistory(batch Batch) {
+	self.history = append(self.history, batch)
+	if len(self.history) > maxHistory {
+		self.history = self.history[len(self.history)-maxHistory:]
+		self.base = self.history[0].Seq - 1
+	}
+}
+
+// Recover replays batches committed to the journal, but not yet in
+// the snapshot, and writes the fresh snapshot. A torn or bad tail of
+// the journal is cut, so new batches are not appended after it.
+func (self *FsData) Recover(file string, journal *Journal) error {
+	self.init()
+
+	n, end, err := journal.Replay(func(batch Batch) {
+		if batch.Seq <= self.Seq {
+			return
+		}
+
+		for _, m := range batch.Mutations {
+			self.apply(m)
+		}
+		self.Seq = batch.Seq
+		self.addHistory(batch)
+	})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return journal.TruncateAt(end)
+	}
+
+	if err := self.Write(file); err != nil {
+		return err
+	}
+	return journal.Truncate()
+}
+
+// Delta returns changes made after the seq, or the whole metadata, if
+// these changes are not known anymore. Zero seq means nothing is known.
+func (self *FsData) Delta(since uint64) Delta {
+	self.init()
+	if since == 0 || since < self.base || since > self.Seq {
+		return Delta{
+			Full:    true,
+			To:      self.Seq,
+			Chunks:  self.Chunks,
+			Expires: self.Expires,
+		}
+	}
+
+	res := Delta{
+		From:      since,
+		To:        self.Seq,
+		Mutations: []Mutation{},
+	}
+	for _, batch := range self.history {
+		if batch.Seq > since {
+			res.Mutations = append(res.Mutations, batch.Mutations...)
+		}
+	}
+	return res
+}
+
+func (self *FsData) ApplyDelta(delta Delta) error {
+	if delta.Full {
+		self.Chunks = delta.Chunks
+		self.Expires = delta.Expires
+		self.Seq = delta.To
+		self.reindex()
+		return nil
+	}
+
+	if delta.From != self.Seq {
+		return errors.New(fmt.Sprintf("Delta from %d doesn't match metadata seq %d.", delta.From, self.Seq))
+	}
+
+	for _, m := range delta.Mutations {
+		self.apply(m)
+	}
+	self.Seq = delta.To
+	return nil
 }
 
 func (self *FsData) Read(name string) error {
 	self.Chunks = nil
+	self.Expires = nil
+	self.index = nil
+	self.log = nil
+	self.undo = nil
+	self.history = nil
 
 	p := path.Clean(name)
 	dir, err := ioutil.ReadDir(p)
@@ -61,6 +465,7 @@ func (self *FsData) Read(name string) error {
 	}
 
 	self.Chunks = make(map[string]*ChunkData)
+	self.Expires = make(map[string]int64)
 	for _, v := range dir {
 		if v.IsDir() {
 			continue
@@ -77,10 +482,26 @@ func (self *FsData) Read(name string) error {
 		}
 
 		var chunks map[string]*ChunkData
-		if err := json.Unmarshal(bs, &chunks); err != nil {
+		var expires map[string]int64
+		var seq uint64 = 0
+		if isBinarySnapshot(bs) {
+			chunks, expires, seq, err = decodeSnapshot(bs)
+			if err != nil {
+				return err
+			}
+		} else if err := json.Unmarshal(bs, &chunks); err != nil {
+			// the old format
 			return err
 		}
 
+		if seq > self.Seq {
+			self.Seq = seq
+		}
+
+		for k, v := range expires {
+			self.Expires[k] = v
+		}
+
 		for k, v := range chunks {
 			_, ok := self.Chunks[k]
 			if !ok {
@@ -90,6 +511,9 @@ func (self *FsData) Read(name string) error {
 				if data.Size != v.Size {
 					return errors.New("Sizes don't match.")
 				}
+				if data.Checksum != v.Checksum {
+					return errors.New("Checksums don't match.")
+				}
 
 				for tag, pair := range v.Tags {
 					data.Tags[tag] = pair
@@ -98,16 +522,28 @@ func (self *FsData) Read(name string) error {
 			}
 		}
 	}
+	self.base = self.Seq
+	self.reindex()
 	return nil
 }
 
-func (self *FsData) Write(file string) error {
-	bs, err := json.MarshalIndent(self.Chunks, "", "\t")
-	if err != nil {
-		return err
+// NextChunkNum returns the number following the last chunk of the table.
+func (self *FsData) NextChunkNum(tag string) uint64 {
+	self.init()
+	var num uint64 = 0
+	for k, _ := range self.index[tag] {
+		for _, n := range self.Chunks[k].Tags[tag] {
+			if n >= num {
+				num = n + 1
+			}
+		}
 	}
+	return num
+}
 
-	return ioutil.WriteFile(file, bs, os.ModePerm)
+func (self *FsData) Write(file string) error {
+	self.init()
+	return WriteFileAtomic(file, encodeSnapshot(self.Chunks, self.Expires, self.Seq))
 }
 
 func (self *FsData) ClearFs(name string) {
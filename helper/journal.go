@@ -0,0 +1,154 @@
+package helper
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+)
+
+// Mutation is a single change of the tags metadata.
+// Mutations are idempotent, so replaying the journal over a snapshot,
+// which already contains some of them, is safe.
+// Checksum is crc32c of the chunk file, zero if unknown.
+// set_expire keeps the expiration time of the table Tag in Num.
+type Mutation struct {
+	Op       string `json:"op"`
+	Chunk    string `json:"chunk"`
+	Tag      string `json:"tag,omitempty"`
+	Num      uint64 `json:"num,omitempty"`
+	Size     uint64 `json:"size,omitempty"`
+	Checksum uint32 `json:"checksum,omitempty"`
+}
+
+// maxRecord limits the size of a journal record, so a torn header
+// can't cause a huge allocation.
+const maxRecord = 256 << 20
+
+// Journal is a write-ahead log of mutation batches. Every record is
+// the length and the CRC32 of the batch followed by the batch itself.
+type Journal struct {
+	file  string
+	count int
+}
+
+func (self *Journal) Append(batch Batch) (rerr error) {
+	bs, err := batch.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header, uint32(len(bs)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.ChecksumIEEE(bs))
+
+	f, err := os.OpenFile(self.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+
+	if err := WriteAll(f, append(header, bs...)); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	self.count++
+	return nil
+}
+
+// Replay calls the callback for every complete batch and returns their count
+// and the offset right after the last of them. The last batch may be torn by
+// a crash, it was never committed then. Replay stops at the first bad record,
+// so everything after the offset has to be cut before appending.
+func (self *Journal) Replay(callback func(batch Batch)) (int, int64, error) {
+	self.count = 0
+	f, err := os.Open(self.file)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	header := make([]byte, 8)
+	var offset int64 = 0
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+
+		l := binary.LittleEndian.Uint32(header)
+		if l > maxRecord {
+			break
+		}
+
+		bs := make([]byte, l)
+		if _, err := io.ReadFull(reader, bs); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(bs) != binary.LittleEndian.Uint32(header[4:]) {
+			break
+		}
+
+		var batch Batch
+		if err := batch.UnmarshalBinary(bs); err != nil {
+			break
+		}
+
+		callback(batch)
+		self.count++
+		offset += int64(len(header) + len(bs))
+	}
+	return self.count, offset, nil
+}
+
+// Count returns the number of batches in the journal.
+func (self *Journal) Count() int {
+	return self.count
+}
+
+func (self *Journal) Truncate() error {
+	err := os.Remove(self.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	self.count = 0
+	return SyncDir(path.Dir(self.file))
+}
+
+// TruncateAt cuts the journal after the offset returned by Replay.
+func (self *Journal) TruncateAt(offset int64) error {
+	f, err := os.OpenFile(self.file, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func NewJournal(file string) Journal {
+	return Journal{
+		file: file,
+	}
+}
@@ -0,0 +1,67 @@
+package helper
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func recoverFsData(t *testing.T, dir string, journal *Journal) *FsData {
+	data := &FsData{}
+	if err := data.Read(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.Recover(path.Join(dir, "1.fsdat"), journal); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRecoverCutsTornJournal(t *testing.T) {
+	dir := t.TempDir()
+	file := path.Join(dir, "1.fsdat.wal")
+	// a header of a record, which was never written completely
+	if err := ioutil.WriteFile(file, []byte{100, 0, 0, 0, 1, 2, 3, 4, 5}, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	journal := NewJournal(file)
+	data := recoverFsData(t, dir, &journal)
+	data.AddChunk("a", "", 1, 0)
+	data.AddTag("a", "t", 0)
+	if err := data.Commit(path.Join(dir, "1.fsdat"), &journal); err != nil {
+		t.Fatal(err)
+	}
+
+	journal = NewJournal(file)
+	data = recoverFsData(t, dir, &journal)
+	if _, ok := data.Chunks["a"]; !ok {
+		t.Fatal("batch appended after the torn record is lost")
+	}
+	if data.Seq != 1 {
+		t.Error("recovered seq is", data.Seq)
+	}
+}
+
+func TestCommitIgnoresFailedCompaction(t *testing.T) {
+	dir := t.TempDir()
+	journal := NewJournal(path.Join(dir, "1.fsdat.wal"))
+	journal.count = compactBatches
+
+	// the snapshot can't be written to a missing directory
+	data := &FsData{}
+	data.AddChunk("a", "", 1, 0)
+	if err := data.Commit(path.Join(dir, "missing", "1.fsdat"), &journal); err != nil {
+		t.Fatal("durable batch is reported as failed:", err)
+	}
+	if len(data.Pending()) != 0 || data.Seq != 1 {
+		t.Error("batch is not committed")
+	}
+
+	journal = NewJournal(path.Join(dir, "1.fsdat.wal"))
+	data = recoverFsData(t, dir, &journal)
+	if _, ok := data.Chunks["a"]; !ok {
+		t.Error("committed batch is lost")
+	}
+}
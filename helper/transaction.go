@@ -12,6 +12,28 @@ type Params struct {
 	Chunks       []string        `json:"chunks"`
 	OutputTables []string        `json:"output_tables"`
 	OutputChunkNums []uint64 `json:"output_chunks_nums"`
+	Steps        []Step          `json:"steps"`
+	Prepared     string          `json:"prepared"`
+	Since        uint64          `json:"since"`
+	Repair       bool            `json:"repair"`
+	Active       []string        `json:"active"`
+	Expires      int64           `json:"expires"`
+	ChunksData   map[string]ChunkData `json:"chunks_data"`
+}
+
+// SlaveInfo is sent by slaves on connect. Machine, Rack and Labels come
+// from the cluster config.
+type SlaveInfo struct {
+	Fileserver string            `json:"fileserver"`
+	Machine    string            `json:"machine"`
+	Rack       string            `json:"rack"`
+	Labels     map[string]string `json:"labels"`
+}
+
+// Step is a single metadata operation of a two-phase commit.
+type Step struct {
+	Action string `json:"action"`
+	Params Params `json:"params"`
 }
 
 type Transaction struct {
@@ -30,6 +52,16 @@ func (self *Transaction) Send(conn net.Conn) error {
 	return WriteAll(conn, bytes)
 }
 
+// DecodePayload converts the payload, decoded as a generic value,
+// to the value of the specific type.
+func DecodePayload(payload interface{}, v interface{}) error {
+	bytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, v)
+}
+
 func NewTransaction(action string) Transaction {
 	return Transaction{
 		Id:     uuid.New(),
@@ -1,7 +1,11 @@
 package helper
 
 import (
+	"HipstMR/utils"
+	"hash/crc32"
 	"io"
+	"os"
+	"path"
 )
 
 func WriteAll(writer io.Writer, buf []byte) error {
@@ -20,3 +24,75 @@ func WriteAll(writer io.Writer, buf []byte) error {
 	}
 	return nil
 }
+
+// WriteFileAtomic replaces the file, so that after a crash it contains
+// either the old data or the new one, but never a mix of them.
+func WriteFileAtomic(file string, data []byte) error {
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if err := WriteAll(f, data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return RenameSync(tmp, file)
+}
+
+// RenameSync renames the file and makes the rename durable.
+func RenameSync(from, to string) error {
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	return SyncDir(path.Dir(to))
+}
+
+func SyncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+// FileChecksum returns crc32c of the file contents and its size.
+func FileChecksum(name string) (uint32, uint64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	hash := crc32.New(utils.Castagnoli)
+	n, err := io.Copy(hash, f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return hash.Sum32(), uint64(n), nil
+}
+
+// Hostname names the host in errors about its chunks.
+func Hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown host"
+	}
+	return name
+}
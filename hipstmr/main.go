@@ -0,0 +1,315 @@
+package main
+
+import (
+	"HipstMR/lib/go/hipstmr"
+	"HipstMR/utils"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+func usage() {
+	fmt.Println("Usage: hipstmr -master <address> <command>")
+	fmt.Println("Commands:")
+	fmt.Println("  status         show slaves, their bad chunks, scrub and gc progress")
+	fmt.Println("  fsck           check metadata and chunk files, -repair fixes what it can")
+	fmt.Println("  stat           show a table: stat <table>")
+	fmt.Println("  ttl            make a table expire, 0 means never: ttl <table> <duration>")
+	fmt.Println("  snapshot       freeze a table: snapshot <table> <name>")
+	fmt.Println("  snapshots      list snapshots: snapshots [table]")
+	fmt.Println("  drop-snapshot  remove a snapshot: drop-snapshot <table> <name>")
+	fmt.Println("  merge          merge small chunks of a table: merge [-chunk-size <bytes>] <table>")
+	fmt.Println("  locks          list tables locked by running operations")
+	fmt.Println("  balance        move chunks from fuller slaves to emptier ones now")
+	fmt.Println("  decommission   retire a slave or host: decommission [-config <file>] <slave|host>")
+	fmt.Println("  undrop         restore the last dropped version of a table: undrop <table>")
+	fmt.Println("  empty-trash    remove dropped tables for good")
+	flag.PrintDefaults()
+}
+
+func status(server hipstmr.Server) error {
+	st, err := server.Status()
+	if err != nil {
+		return err
+	}
+
+	for _, slave := range st.Slaves {
+		fmt.Printf("Slave %s (fileserver %q): %d chunks, %d bytes\n", slave.Id, slave.Fileserver, slave.Chunks, slave.Used)
+		if len(slave.Bad) != 0 {
+			fmt.Println("  bad chunks:", slave.Bad)
+		}
+		if slave.Machine != "" {
+			labels := []string{}
+			for label, value := range slave.Labels {
+				labels = append(labels, label+"="+value)
+			}
+			sort.Strings(labels)
+			fmt.Printf("  machine %s, rack %q, labels %s\n", slave.Machine, slave.Rack, strings.Join(labels, ","))
+		}
+		if slave.Full {
+			fmt.Println("  full: no space for new outputs")
+		}
+		for _, disk := range slave.Disks {
+			if disk.Failed {
+				fmt.Printf("  disk %s: failed\n", disk.Mnt)
+			} else {
+				fmt.Printf("  disk %s: %d of %d bytes free, %d available\n", disk.Mnt, disk.Free, disk.Total, disk.Available)
+			}
+		}
+
+		scrub := slave.Scrub
+		state := "idle"
+		if scrub.Running {
+			state = "running since " + time.Unix(scrub.Started, 0).Format(time.RFC3339)
+		} else if scrub.Finished != 0 {
+			state = "finished at " + time.Unix(scrub.Finished, 0).Format(time.RFC3339)
+		}
+		fmt.Printf("  scrub: %s, %d passes, checked %d/%d chunks, %d bytes\n",
+			state, scrub.Passes, scrub.Checked, scrub.Total, scrub.Bytes)
+		if len(scrub.Corrupt) != 0 {
+			fmt.Println("  corrupt:", scrub.Corrupt)
+		}
+		if len(scrub.Missing) != 0 {
+			fmt.Println("  missing:", scrub.Missing)
+		}
+
+		gc := slave.Gc
+		if gc.Runs != 0 {
+			verb := "reclaimed"
+			if gc.DryRun {
+				verb = "would reclaim (dry run)"
+			}
+			fmt.Printf("  gc: %d runs, last at %s, %s %d bytes (%d last run): %d dirs, %d chunks, %d tables\n",
+				gc.Runs, time.Unix(gc.Last, 0).Format(time.RFC3339), verb, gc.Total.Bytes, gc.LastRun.Bytes,
+				gc.Total.Dirs, gc.Total.Chunks, gc.Total.Tables)
+		}
+
+		if d := slave.Decommission; d != nil {
+			state := d.State
+			if d.State == "draining" {
+				state = fmt.Sprintf("draining, waiting for %d tasks", d.Jobs)
+			} else if d.State == "copying" {
+				state = fmt.Sprintf("copying, %d chunks left", d.Chunks)
+				if d.Jobs != 0 {
+					state += fmt.Sprintf(", waiting for %d tasks", d.Jobs)
+				}
+			} else if d.State == "done" {
+				state = "done at " + time.Unix(d.Finished, 0).Format(time.RFC3339) + ", safe to remove"
+			} else if d.State == "failed" {
+				state = "failed at " + time.Unix(d.Finished, 0).Format(time.RFC3339)
+			}
+			fmt.Printf("  decommission: %s, copied %d chunks, %d bytes since %s\n",
+				state, d.Copied, d.Bytes, time.Unix(d.Started, 0).Format(time.RFC3339))
+			if d.Error != "" {
+				fmt.Println("  decommission error:", d.Error)
+			}
+		}
+	}
+	return nil
+}
+
+func stat(server hipstmr.Server, tbl string) error {
+	st, err := server.Stat(tbl)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Table %s: %d chunks, %d bytes on %d slaves\n", st.Name, st.Chunks, st.Size, st.Slaves)
+	if st.Readers != 0 {
+		fmt.Printf("  read by %d running operations\n", st.Readers)
+	}
+	if st.Expires != 0 {
+		fmt.Printf("  expires at %s, in %s\n", time.Unix(st.Expires, 0).Format(time.RFC3339), st.Ttl)
+	}
+	return nil
+}
+
+func snapshots(server hipstmr.Server, tbl string) error {
+	list, err := server.Snapshots(tbl)
+	if err != nil {
+		return err
+	}
+
+	for _, snapshot := range list {
+		fmt.Printf("%s@%s: %d chunks, %d bytes, read as %s\n", snapshot.Table, snapshot.Name,
+			snapshot.Chunks, snapshot.Size, hipstmr.SnapshotTable(snapshot.Table, snapshot.Name))
+	}
+	return nil
+}
+
+func locks(server hipstmr.Server) error {
+	list, err := server.Locks()
+	if err != nil {
+		return err
+	}
+
+	for _, l := range list {
+		fmt.Printf("%s: %s by %s %s since %s\n", l.Table, l.Mode, l.Type, l.Transaction,
+			time.Unix(l.Since, 0).Format(time.RFC3339))
+	}
+	return nil
+}
+
+func balance(server hipstmr.Server) error {
+	stats, err := server.Balance()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Moved %d chunks, %d bytes\n", stats.Chunks, stats.Bytes)
+	return nil
+}
+
+// decommission checks the host against the cluster config, if it is given.
+func decommission(server hipstmr.Server, args []string) error {
+	flags := flag.NewFlagSet("decommission", flag.ExitOnError)
+	config := flags.String("config", "", "cluster config to find the host in")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := flags.Arg(0)
+	if *config != "" {
+		cfg, err := utils.NewConfig(*config)
+		if err != nil {
+			return err
+		}
+		if cfg.GetMachineCfg(name) == nil {
+			return errors.New("No machine " + name + " in " + cfg.Name + ".")
+		}
+	}
+
+	ids, err := server.Decommission(name)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		fmt.Println("Decommissioning slave", id)
+	}
+	return nil
+}
+
+func merge(server hipstmr.Server, args []string) error {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	chunkSize := flags.Int64("chunk-size", hipstmr.DefaultChunkSize, "size of merged chunks")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	return server.Merge(hipstmr.NewParams().AddInput(flags.Arg(0)).SetChunkSize(*chunkSize))
+}
+
+func fsck(server hipstmr.Server, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "fix what can be fixed")
+	flags.Parse(args)
+
+	report, err := server.Fsck(*repair)
+	if err != nil {
+		return err
+	}
+
+	for _, issue := range report.Issues {
+		str := issue.Kind
+		if issue.Slave != "" {
+			str += " slave " + issue.Slave
+		}
+		if issue.Table != "" {
+			str += " table " + issue.Table
+		}
+		if issue.Chunk != "" {
+			str += " chunk " + issue.Chunk
+		}
+		if issue.Kind == "duplicate" {
+			str += fmt.Sprintf(" num %d", issue.Num)
+		}
+		if issue.Details != "" {
+			str += ": " + issue.Details
+		}
+		if issue.Repaired {
+			str += " (repaired)"
+		}
+		fmt.Println(str)
+	}
+	fmt.Println(len(report.Issues), "issues found")
+	return nil
+}
+
+func main() {
+	help := flag.Bool("help", false, "print this help")
+	master := flag.String("master", "", "master adress")
+	flag.Parse()
+	if *help || *master == "" || flag.NArg() == 0 {
+		usage()
+		return
+	}
+
+	server := hipstmr.NewServer(*master)
+
+	var err error = nil
+	switch flag.Arg(0) {
+	case "status":
+		err = status(server)
+	case "fsck":
+		err = fsck(server, flag.Args()[1:])
+	case "stat":
+		if flag.NArg() != 2 {
+			usage()
+			os.Exit(2)
+		}
+		err = stat(server, flag.Arg(1))
+	case "ttl":
+		if flag.NArg() != 3 {
+			usage()
+			os.Exit(2)
+		}
+		var ttl time.Duration
+		if ttl, err = time.ParseDuration(flag.Arg(2)); err == nil {
+			err = server.SetTtl(flag.Arg(1), ttl)
+		}
+	case "snapshot", "drop-snapshot":
+		if flag.NArg() != 3 {
+			usage()
+			os.Exit(2)
+		}
+		if flag.Arg(0) == "snapshot" {
+			err = server.Snapshot(flag.Arg(1), flag.Arg(2))
+		} else {
+			err = server.DropSnapshot(flag.Arg(1), flag.Arg(2))
+		}
+	case "snapshots":
+		err = snapshots(server, flag.Arg(1))
+	case "merge":
+		err = merge(server, flag.Args()[1:])
+	case "locks":
+		err = locks(server)
+	case "balance":
+		err = balance(server)
+	case "decommission":
+		err = decommission(server, flag.Args()[1:])
+	case "undrop":
+		if flag.NArg() != 2 {
+			usage()
+			os.Exit(2)
+		}
+		err = server.Undrop(flag.Arg(1))
+	case "empty-trash":
+		err = server.EmptyTrash()
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,23 @@
+package hipstmr
+
+// BalanceStats counts chunks moved between slaves by balancing.
+type BalanceStats struct {
+	Chunks uint64 `json:"chunks"`
+	Bytes  uint64 `json:"bytes"`
+}
+
+// Balance moves chunks from slaves storing more data to the ones storing
+// less right away, without waiting for the periodic balancing.
+func (self *Server) Balance() (BalanceStats, error) {
+	var trans transaction
+	trans.Params = &Params{
+		Type: "balance",
+	}
+	trans.Status = "starting"
+
+	var res BalanceStats
+	if err := self.queryPayload(&trans, &res); err != nil {
+		return BalanceStats{}, err
+	}
+	return res, nil
+}
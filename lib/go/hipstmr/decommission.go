@@ -0,0 +1,19 @@
+package hipstmr
+
+// Decommission retires the slave with the id, or all the slaves of
+// the host, and returns their ids. No new tasks are sent to them and
+// their chunks are copied to other slaves, status shows the progress.
+func (self *Server) Decommission(slave string) ([]string, error) {
+	var trans transaction
+	trans.Params = &Params{
+		Type: "decommission",
+		Name: slave,
+	}
+	trans.Status = "starting"
+
+	var res []string
+	if err := self.queryPayload(&trans, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
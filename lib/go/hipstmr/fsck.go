@@ -0,0 +1,42 @@
+package hipstmr
+
+// FsckIssue is an inconsistency between the master index, metadata
+// of a slave and chunk files on it. Kind is one of:
+//
+//	orphan    - a chunk file, which is not in metadata
+//	missing   - a chunk in metadata without a file
+//	size      - the file size differs from the one in metadata
+//	disk      - the file is on another disk than recorded in metadata
+//	tmp       - a temporary table or directory left by a finished job
+//	duplicate - different chunks with the same number in a table
+//	gap       - a table misses chunks with the number
+type FsckIssue struct {
+	Kind     string `json:"kind"`
+	Slave    string `json:"slave,omitempty"`
+	Table    string `json:"table,omitempty"`
+	Chunk    string `json:"chunk,omitempty"`
+	Num      uint64 `json:"num,omitempty"`
+	Details  string `json:"details,omitempty"`
+	Repaired bool   `json:"repaired"`
+}
+
+type FsckReport struct {
+	Issues []FsckIssue `json:"issues"`
+}
+
+// Fsck checks the consistency of the cluster, fixing what can be fixed
+// with the repair set.
+func (self *Server) Fsck(repair bool) (FsckReport, error) {
+	var trans transaction
+	trans.Params = &Params{
+		Type:   "fsck",
+		Repair: repair,
+	}
+	trans.Status = "starting"
+
+	var report FsckReport
+	if err := self.queryPayload(&trans, &report); err != nil {
+		return FsckReport{}, err
+	}
+	return report, nil
+}
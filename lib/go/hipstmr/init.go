@@ -1,9 +1,13 @@
 package hipstmr
 
 import (
+	"HipstMR/utils"
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
@@ -31,12 +35,55 @@ func Init() {
 
 type jobConfig struct {
 	Mnt  string `json:"mnt"`
+	Files        map[string]string `json:"files"`
 	Jtype        string   `json:"type"`
 	Name         string   `json:"name"`
 	Dir          string   `json:"dir"`
 	Chunks       []string `json:"chunks"`
 	OutputTables []string `json:"output_tables"`
 	Object       []byte   `json:"object"`
+	Checksums    map[string]uint32 `json:"checksums"`
+	Host         string   `json:"host"`
+	ChunkSize    int64    `json:"chunk_size"`
+}
+
+// fail reports the error in the last line of stderr, the slave passes it
+// to the master.
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	os.Exit(1)
+}
+
+// checkedReader verifies crc32c of the chunk once it's read to the end.
+type checkedReader struct {
+	reader   io.Reader
+	hash     hash.Hash32
+	checksum uint32
+	chunk    string
+	host     string
+}
+
+func (self *checkedReader) Read(p []byte) (int, error) {
+	n, err := self.reader.Read(p)
+	self.hash.Write(p[:n])
+	if err == io.EOF && self.hash.Sum32() != self.checksum {
+		return n, errors.New("Chunk " + self.chunk + " on " + self.host + " is corrupted: checksum mismatch.")
+	}
+	return n, err
+}
+
+func chunkReader(cfg jobConfig, chunk string, reader io.Reader) io.Reader {
+	checksum, ok := cfg.Checksums[chunk]
+	if !ok {
+		return reader
+	}
+	return &checkedReader{
+		reader:   reader,
+		hash:     crc32.New(utils.Castagnoli),
+		checksum: checksum,
+		chunk:    chunk,
+		host:     cfg.Host,
+	}
 }
 
 func parseConfig() (jobConfig, error) {
@@ -64,13 +111,18 @@ func runMap(cfg jobConfig) {
 	var baseReaders []io.ReadCloser
 	var readers []io.Reader
 	for _, c := range cfg.Chunks {
-		f, err := os.Open(path.Join(cfg.Mnt, c+".chunk"))
+		name, ok := cfg.Files[c]
+		if !ok {
+			// slaves with a single disk keep chunks in the job mount
+			name = path.Join(cfg.Mnt, c+".chunk")
+		}
+		f, err := os.Open(name)
 		if err != nil {
-			fmt.Println(err)
+			fail(errors.New("Chunk " + c + " on " + cfg.Host + ": " + err.Error()))
 		}
 
 		baseReaders = append(baseReaders, f)
-		readers = append(readers, bufio.NewReader(f))
+		readers = append(readers, chunkReader(cfg, c, bufio.NewReader(f)))
 	}
 	reader := io.MultiReader(readers...)
 	defer func() {
@@ -93,17 +145,17 @@ func runMap(cfg jobConfig) {
 			break
 		}
 		if err != nil {
-			fmt.Println(err)
+			fail(err)
 		}
 
 		subKey, err := readValue(reader)
 		if err != nil {
-			fmt.Println(err)
+			fail(err)
 		}
 
 		value, err := readValue(reader)
 		if err != nil {
-			fmt.Println(err)
+			fail(err)
 		}
 
 		job.Do(key, subKey, value, output)
@@ -0,0 +1,27 @@
+package hipstmr
+
+// LockInfo is a lock of a table held by an operation. Mode is either
+// "shared" or "exclusive", Since is the unix time the lock was taken.
+type LockInfo struct {
+	Table       string `json:"table"`
+	Mode        string `json:"mode"`
+	Transaction string `json:"transaction"`
+	Type        string `json:"type"`
+	Since       int64  `json:"since"`
+}
+
+// Locks lists locks held by running operations. Operations lock their
+// input tables shared and tables they change exclusively.
+func (self *Server) Locks() ([]LockInfo, error) {
+	var trans transaction
+	trans.Params = &Params{
+		Type: "locks",
+	}
+	trans.Status = "starting"
+
+	var res []LockInfo
+	if err := self.queryPayload(&trans, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -1,10 +1,12 @@
 package hipstmr
 
 import (
+	"HipstMR/utils"
 	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path"
@@ -17,7 +19,8 @@ type JobOutput struct {
 	current      int
 	mnt          string
 	dir          string
-	maxChunkSize int
+	host         string
+	maxChunkSize int64
 }
 
 func (self *JobOutput) close() error {
@@ -50,12 +53,19 @@ func (self *JobOutput) writeChunk(cur int) error {
 	defer f.Close()
 
 	n, err := f.Write(buf.Bytes())
+	if utils.IsNoSpace(err) {
+		// the rest of the output is lost anyway
+		fail(errors.New("No space left on " + self.host + " for output of table " + self.tables[cur] + "."))
+	}
 	if err != nil {
 		return err
 	}
 	if n != buf.Len() {
 		return errors.New(fmt.Sprintf("Wrote only %d bytes from %d.", n, buf.Len()))
 	}
+	if err := utils.WriteChecksum(name, crc32.Checksum(buf.Bytes(), utils.Castagnoli)); err != nil {
+		return err
+	}
 
 	self.counters[cur]++
 	buf.Reset()
@@ -78,7 +88,7 @@ func (self *JobOutput) Add(key, subKey, value []byte) error {
 	buf := self.buffers[cur]
 	size := buf.Len()
 	newSize := size + 2*3 + len(key) + len(subKey) + len(value)
-	if newSize > self.maxChunkSize {
+	if int64(newSize) > self.maxChunkSize {
 		if err := self.writeChunk(cur); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 		}
@@ -107,24 +117,23 @@ func (self *JobOutput) AddStr(key, subKey, value string) error {
 	return self.Add([]byte(key), []byte(subKey), []byte(value))
 }
 
+// readValue returns io.EOF only if there are no more values,
+// a truncated value is an error.
 func readValue(reader io.Reader) ([]byte, error) {
 	bs := []byte{0, 0}
-	n, err := reader.Read(bs)
-	if err != nil {
+	if _, err := io.ReadFull(reader, bs); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("Truncated value length.")
+		}
 		return nil, err
 	}
-	if n != 2 {
-		return nil, errors.New("!!! 11")
-	}
 
 	l := binary.LittleEndian.Uint16(bs)
 	buf := make([]byte, l, l)
-	n, err = reader.Read(buf)
-	if n != int(l) {
-		fmt.Println(n)
-		return nil, errors.New("!!! 12")
-	}
-	if err != nil {
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errors.New("Truncated value.")
+		}
 		return nil, err
 	}
 	return buf, nil
@@ -158,12 +167,18 @@ func newOutput(cfg jobConfig, mnt string) (*JobOutput, error) {
 		buffers[i] = &bytes.Buffer{}
 	}
 
+	chunkSize := cfg.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+
 	return &JobOutput{
 		mnt:          mnt,
 		dir:          cfg.Dir,
+		host:         cfg.Host,
 		tables:       cfg.OutputTables,
 		current:      0,
-		maxChunkSize: 40,
+		maxChunkSize: chunkSize,
 		buffers:      buffers,
 		counters:     make([]uint, len(cfg.OutputTables)), // assume default zero
 	}, nil
@@ -5,24 +5,42 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type Params struct {
-	InputTables  []string          `json:"input_tables"`
-	OutputTables []string          `json:"output_tables"`
-	Files        map[string][]byte `json:"files"`
-	Type         string            `json:"type"`
-	Name         string            `json:"name"`
-	Object       []byte            `json:"job"`
+	InputTables  []string                 `json:"input_tables"`
+	OutputTables []string                 `json:"output_tables"`
+	AppendTables []string                 `json:"append_tables"`
+	Files        map[string][]byte        `json:"files"`
+	Type         string                   `json:"type"`
+	Name         string                   `json:"name"`
+	Object       []byte                   `json:"job"`
+	Steps        []*Params                `json:"steps"`
+	Repair       bool                     `json:"repair"`
+	Ttl          map[string]time.Duration `json:"ttl"`
+	NoWait       bool                     `json:"no_wait"`
+	ChunkSize    int64                    `json:"chunk_size"`
+	NodeSelector map[string]string        `json:"node_selector"`
 }
 
+// DefaultChunkSize is the size of output chunks, unless Params set it.
+const DefaultChunkSize = 64 << 20
+
 func (self *Params) MarshalJSON() ([]byte, error) {
 	obj := make(map[string]interface{})
 	obj["name"] = self.Name
 	obj["type"] = self.Type
 	obj["input_tables"] = self.InputTables
 	obj["output_tables"] = self.OutputTables
+	obj["append_tables"] = self.AppendTables
 	obj["job"] = self.Object
+	obj["steps"] = self.Steps
+	obj["repair"] = self.Repair
+	obj["ttl"] = self.Ttl
+	obj["no_wait"] = self.NoWait
+	obj["chunk_size"] = self.ChunkSize
+	obj["node_selector"] = self.NodeSelector
 	files := make(map[string][]byte)
 	for k, v := range self.Files {
 		isSelf := false
@@ -71,6 +89,56 @@ func (self *Params) AddOutput(name string) *Params {
 	return self
 }
 
+// AddOutputAppend adds an output table, whose existing chunks are kept:
+// new chunks are numbered after them instead of replacing them.
+func (self *Params) AddOutputAppend(name string) *Params {
+	self.OutputTables = append(self.OutputTables, name)
+	self.AppendTables = append(self.AppendTables, name)
+	return self
+}
+
+// SetTtl makes the output table expire after the time, see Server.SetTtl.
+func (self *Params) SetTtl(name string, ttl time.Duration) *Params {
+	if self.Ttl == nil {
+		self.Ttl = make(map[string]time.Duration)
+	}
+	self.Ttl[name] = ttl
+	return self
+}
+
+// SetNoWait makes the operation fail at once if tables it needs are
+// locked by other operations, instead of waiting for them.
+func (self *Params) SetNoWait() *Params {
+	self.NoWait = true
+	return self
+}
+
+// SetChunkSize sets the size of output chunks. Chunks are cut at record
+// boundaries, so they may be a bit smaller.
+func (self *Params) SetChunkSize(size int64) *Params {
+	self.ChunkSize = size
+	return self
+}
+
+// SetNodeSelector makes the job run only on slaves of machines, which
+// have the label with the value.
+func (self *Params) SetNodeSelector(label, value string) *Params {
+	if self.NodeSelector == nil {
+		self.NodeSelector = make(map[string]string)
+	}
+	self.NodeSelector[label] = value
+	return self
+}
+
+func (self *Params) IsAppend(name string) bool {
+	for _, v := range self.AppendTables {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
 func NewParams() *Params {
 	return (&Params{
 		InputTables:  []string{},
@@ -3,6 +3,7 @@ package hipstmr
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -102,6 +103,7 @@ func (self *Server) CopyIO(from, to string) error {
 	return self.Copy(NewParamsIO(from, to))
 }
 
+// Drop moves the input tables to the trash, see Undrop.
 func (self *Server) Drop(params *Params) error {
 	files := params.Files
 	params.Files = nil
@@ -121,20 +123,49 @@ func (self *Server) DropTbl(tbl string) error {
 	return self.Drop(NewParams().AddInput(tbl))
 }
 
+// Merge rewrites the input table into chunks of the chunk size set in
+// the params, keeping the order of records. Only small chunks are merged,
+// ones of at least the chunk size are left as they are and only renumbered.
+func (self *Server) Merge(params *Params) error {
+	files := params.Files
+	params.Files = nil
+	defer func() {
+		params.Files = files
+	}()
+	params.Type = "merge"
+
+	var trans transaction
+	trans.Params = params
+	trans.Status = "starting"
+
+	return self.run(&trans)
+}
+
+func (self *Server) MergeTbl(tbl string) error {
+	return self.Merge(NewParams().AddInput(tbl))
+}
+
 func (self *Server) run(trans *transaction) error {
+	_, err := self.query(trans)
+	return err
+}
+
+// query runs the transaction and returns the last message about it.
+func (self *Server) query(trans *transaction) (transaction, error) {
+	var last transaction
 	res, err := json.Marshal(trans)
 	if err != nil {
-		return err
+		return last, err
 	}
 
 	conn, err := net.Dial("tcp", self.address)
 	if err != nil {
-		return err
+		return last, err
 	}
 	defer conn.Close()
 
 	if err := writeAll(conn, res); err != nil {
-		return err
+		return last, err
 	}
 
 	reader := bufio.NewReader(conn)
@@ -148,10 +179,17 @@ func (self *Server) run(trans *transaction) error {
 		}
 
 		if err != nil {
-			return err
+			return last, err
 		}
 
 		fmt.Println("Transaction " + t.Id + ": " + t.Status)
+		if t.Status == "failed" {
+			if str, ok := t.Payload.(string); ok && str != "" {
+				return last, errors.New("Transaction " + t.Id + " failed: " + str)
+			}
+			return last, errors.New("Transaction " + t.Id + " failed.")
+		}
+		last = t
 
 		str, ok := t.Payload.(string)
 		if ok {
@@ -159,7 +197,7 @@ func (self *Server) run(trans *transaction) error {
 			fmt.Println(str)
 		}
 	}
-	return nil
+	return last, nil
 }
 
 func writeAll(writer io.Writer, buf []byte) error {
@@ -0,0 +1,77 @@
+package hipstmr
+
+import (
+	"strings"
+)
+
+// SnapshotPrefix starts names of all the snapshot tables.
+const SnapshotPrefix = ".snapshot/"
+
+// SnapshotTable returns the name of the read-only table, which keeps
+// the snapshot. Jobs read snapshots as any other table.
+func SnapshotTable(tbl, name string) string {
+	return SnapshotPrefix + tbl + "@" + name
+}
+
+// ParseSnapshotTable returns the table and the name of the snapshot.
+func ParseSnapshotTable(snapshot string) (string, string, bool) {
+	if !strings.HasPrefix(snapshot, SnapshotPrefix) {
+		return "", "", false
+	}
+	pos := strings.LastIndex(snapshot, "@")
+	if pos < len(SnapshotPrefix) {
+		return "", "", false
+	}
+	return snapshot[len(SnapshotPrefix):pos], snapshot[pos+1:], true
+}
+
+func IsSnapshotTable(tbl string) bool {
+	return strings.HasPrefix(tbl, SnapshotPrefix)
+}
+
+type SnapshotInfo struct {
+	Table  string `json:"table"`
+	Name   string `json:"name"`
+	Chunks int    `json:"chunks"`
+	Size   uint64 `json:"size"`
+}
+
+// Snapshot freezes the current state of the table. Snapshots share chunks
+// with the table, so they are cheap, and survive later changes of it.
+func (self *Server) Snapshot(tbl, name string) error {
+	var trans transaction
+	trans.Params = NewParams().AddInput(tbl)
+	trans.Params.Type = "snapshot"
+	trans.Params.Name = name
+	trans.Status = "starting"
+
+	return self.run(&trans)
+}
+
+// Snapshots lists snapshots of the table, or of all the tables if it
+// is empty.
+func (self *Server) Snapshots(tbl string) ([]SnapshotInfo, error) {
+	var trans transaction
+	trans.Params = NewParams()
+	if tbl != "" {
+		trans.Params.AddInput(tbl)
+	}
+	trans.Params.Type = "snapshots"
+	trans.Status = "starting"
+
+	var res []SnapshotInfo
+	if err := self.queryPayload(&trans, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (self *Server) DropSnapshot(tbl, name string) error {
+	var trans transaction
+	trans.Params = NewParams().AddInput(tbl)
+	trans.Params.Type = "drop_snapshot"
+	trans.Params.Name = name
+	trans.Status = "starting"
+
+	return self.run(&trans)
+}
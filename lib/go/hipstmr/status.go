@@ -0,0 +1,114 @@
+package hipstmr
+
+import (
+	"encoding/json"
+)
+
+// ScrubStatus describes verification of chunks on a slave. Corrupt and
+// Missing chunks are found during the current pass, or the last one
+// if the slave is waiting for the next pass.
+type ScrubStatus struct {
+	Passes   uint64   `json:"passes"`
+	Checked  uint64   `json:"checked"`
+	Total    uint64   `json:"total"`
+	Bytes    uint64   `json:"bytes"`
+	Corrupt  []string `json:"corrupt"`
+	Missing  []string `json:"missing"`
+	Started  int64    `json:"started"`
+	Finished int64    `json:"finished"`
+	Running  bool     `json:"running"`
+}
+
+// GcStats counts what garbage collection removed, or would remove
+// in dry run mode.
+type GcStats struct {
+	Dirs   uint64 `json:"dirs"`
+	Chunks uint64 `json:"chunks"`
+	Tables uint64 `json:"tables"`
+	Bytes  uint64 `json:"bytes"`
+}
+
+type GcStatus struct {
+	Runs    uint64  `json:"runs"`
+	Last    int64   `json:"last"`
+	DryRun  bool    `json:"dry_run"`
+	LastRun GcStats `json:"last_run"`
+	Total   GcStats `json:"total"`
+}
+
+// DecommissionStatus describes retiring of a slave. State is "draining"
+// while running tasks finish, "copying" while its chunks are copied to
+// other slaves, "done", when the slave is safe to remove, and "failed",
+// if it disconnected before. Chunks is the number of chunks left to copy.
+type DecommissionStatus struct {
+	State    string `json:"state"`
+	Jobs     int    `json:"jobs"`
+	Chunks   int    `json:"chunks"`
+	Copied   uint64 `json:"copied"`
+	Bytes    uint64 `json:"bytes"`
+	Started  int64  `json:"started"`
+	Finished int64  `json:"finished"`
+	Error    string `json:"error"`
+}
+
+// DiskStatus is the space of a slave mount point. Available is free
+// space above the reserve of the slave, new outputs don't fit if it's 0.
+type DiskStatus struct {
+	Mnt       string `json:"mnt"`
+	Total     uint64 `json:"total"`
+	Free      uint64 `json:"free"`
+	Available uint64 `json:"available"`
+	Failed    bool   `json:"failed"`
+}
+
+// Machine, Rack and Labels come from the cluster config of the slave.
+// Full is set if no disk of the slave has available space.
+type SlaveStatus struct {
+	Id           string              `json:"id"`
+	Fileserver   string              `json:"fileserver"`
+	Machine      string              `json:"machine"`
+	Rack         string              `json:"rack"`
+	Labels       map[string]string   `json:"labels"`
+	Chunks       int                 `json:"chunks"`
+	Used         uint64              `json:"used"`
+	Disks        []DiskStatus        `json:"disks"`
+	Full         bool                `json:"full"`
+	Bad          []string            `json:"bad"`
+	Scrub        ScrubStatus         `json:"scrub"`
+	Gc           GcStatus            `json:"gc"`
+	Decommission *DecommissionStatus `json:"decommission"`
+}
+
+type Status struct {
+	Slaves []SlaveStatus `json:"slaves"`
+}
+
+// Status returns the state of slaves known to the master.
+func (self *Server) Status() (Status, error) {
+	var trans transaction
+	trans.Params = &Params{
+		Type: "status",
+	}
+	trans.Status = "starting"
+
+	var status Status
+	if err := self.queryPayload(&trans, &status); err != nil {
+		return Status{}, err
+	}
+	return status, nil
+}
+
+// queryPayload runs the transaction and decodes the payload of the reply.
+func (self *Server) queryPayload(trans *transaction, v interface{}) error {
+	res, err := self.query(trans)
+	if err != nil {
+		return err
+	}
+
+	// payload is already decoded as a generic value
+	buf, err := json.Marshal(res.Payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
@@ -0,0 +1,43 @@
+package hipstmr
+
+import (
+	"time"
+)
+
+// TableStat describes a table. Expires is zero for tables, which never
+// expire, Ttl is the time left until the table expires. Readers is
+// the number of running operations, which read versions of the table
+// pinned when they started.
+type TableStat struct {
+	Name    string        `json:"name"`
+	Chunks  int           `json:"chunks"`
+	Size    uint64        `json:"size"`
+	Slaves  int           `json:"slaves"`
+	Expires int64         `json:"expires"`
+	Ttl     time.Duration `json:"ttl"`
+	Readers int           `json:"readers"`
+}
+
+func (self *Server) Stat(tbl string) (TableStat, error) {
+	var trans transaction
+	trans.Params = NewParams().AddInput(tbl)
+	trans.Params.Type = "stat"
+	trans.Status = "starting"
+
+	var stat TableStat
+	if err := self.queryPayload(&trans, &stat); err != nil {
+		return TableStat{}, err
+	}
+	return stat, nil
+}
+
+// SetTtl makes the table expire after the time, zero ttl means never.
+// The master drops expired tables, or moves them to the trash.
+func (self *Server) SetTtl(tbl string, ttl time.Duration) error {
+	var trans transaction
+	trans.Params = NewParams().AddInput(tbl).SetTtl(tbl, ttl)
+	trans.Params.Type = "set_ttl"
+	trans.Status = "starting"
+
+	return self.run(&trans)
+}
@@ -0,0 +1,58 @@
+package hipstmr
+
+// Transaction batches several move/copy/drop operations, which are applied
+// atomically: either all of them succeed on every slave or none of them.
+type Transaction struct {
+	server *Server
+	steps  []*Params
+}
+
+func (self *Server) Transaction() *Transaction {
+	return &Transaction{
+		server: self,
+		steps:  []*Params{},
+	}
+}
+
+func (self *Transaction) add(params *Params, typ string) *Transaction {
+	step := *params
+	step.Files = nil
+	step.Type = typ
+	self.steps = append(self.steps, &step)
+	return self
+}
+
+func (self *Transaction) Move(params *Params) *Transaction {
+	return self.add(params, "move")
+}
+
+func (self *Transaction) MoveIO(from, to string) *Transaction {
+	return self.Move(NewParamsIO(from, to))
+}
+
+func (self *Transaction) Copy(params *Params) *Transaction {
+	return self.add(params, "copy")
+}
+
+func (self *Transaction) CopyIO(from, to string) *Transaction {
+	return self.Copy(NewParamsIO(from, to))
+}
+
+func (self *Transaction) Drop(params *Params) *Transaction {
+	return self.add(params, "drop")
+}
+
+func (self *Transaction) DropTbl(tbl string) *Transaction {
+	return self.Drop(NewParams().AddInput(tbl))
+}
+
+func (self *Transaction) Commit() error {
+	var trans transaction
+	trans.Params = &Params{
+		Type:  "transaction",
+		Steps: self.steps,
+	}
+	trans.Status = "starting"
+
+	return self.server.run(&trans)
+}
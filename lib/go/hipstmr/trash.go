@@ -0,0 +1,24 @@
+package hipstmr
+
+// Undrop restores the last dropped version of the table. Dropped tables
+// are kept in the trash for the retention period of the master, the table
+// must not exist.
+func (self *Server) Undrop(tbl string) error {
+	var trans transaction
+	trans.Params = NewParams().AddInput(tbl)
+	trans.Params.Type = "undrop"
+	trans.Status = "starting"
+
+	return self.run(&trans)
+}
+
+// EmptyTrash removes all the dropped tables for good.
+func (self *Server) EmptyTrash() error {
+	var trans transaction
+	trans.Params = &Params{
+		Type: "empty_trash",
+	}
+	trans.Status = "starting"
+
+	return self.run(&trans)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"HipstMR/helper"
+	"HipstMR/lib/go/hipstmr"
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chunkMove is a chunk to be moved or copied between slaves with its metadata.
+type chunkMove struct {
+	from  string
+	to    string
+	chunk string
+	data  helper.ChunkData
+}
+
+func (self *chunkMove) tables() []string {
+	res := make([]string, 0, len(self.data.Tags))
+	for tag, _ := range self.data.Tags {
+		res = append(res, tag)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Used returns the size of chunks stored on the slave.
+func (self *FsData) Used(id string) uint64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.used(id)
+}
+
+func (self *FsData) used(id string) uint64 {
+	var res uint64 = 0
+	fsData, ok := self.slaves[id]
+	if !ok {
+		return 0
+	}
+	for _, ch := range fsData.Chunks {
+		res += ch.Size
+	}
+	return res
+}
+
+// movable tells if the chunk may be moved: chunks read by running
+// operations, temporary ones and bad ones stay where they are.
+func (self *FsData) movable(slave, chunk string) bool {
+	if self.bad[slave][chunk] {
+		return false
+	}
+	for tag, _ := range self.slaves[slave].Chunks[chunk].Tags {
+		if strings.HasPrefix(tag, "tmp/") || strings.HasPrefix(tag, pinPrefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// planMove picks the largest chunk, which can be moved from the most used
+// slave to the least used one with space without making the latter
+// the most used. A chunk is not moved to a rack, which already has its
+// replica, more used slaves are tried for such chunks. Nothing is moved
+// if usage of all the slaves is within threshold of the average.
+func (self *FsData) planMove(slaves []string, threshold float64, skip IdSet) (chunkMove, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if len(slaves) < 2 {
+		return chunkMove{}, false
+	}
+
+	var total uint64 = 0
+	usage := make(map[string]uint64)
+	for _, id := range slaves {
+		usage[id] = self.used(id)
+		total += usage[id]
+	}
+	sort.Slice(slaves, func(i, j int) bool {
+		if usage[slaves[i]] != usage[slaves[j]] {
+			return usage[slaves[i]] > usage[slaves[j]]
+		}
+		return slaves[i] < slaves[j]
+	})
+
+	from := slaves[0]
+	avg := float64(total) / float64(len(slaves))
+	if float64(usage[from]) <= avg*(1+threshold) && float64(usage[slaves[len(slaves)-1]]) >= avg*(1-threshold) {
+		return chunkMove{}, false
+	}
+
+	fsData, ok := self.slaves[from]
+	if !ok {
+		return chunkMove{}, false
+	}
+
+	res := chunkMove{}
+	for i := len(slaves) - 1; i > 0 && res.chunk == ""; i-- {
+		to := slaves[i]
+		if self.full(to) {
+			continue
+		}
+		res.chunk, res.data.Size = self.pickChunk(from, to, (usage[from]-usage[to])/2, skip)
+		res.to = to
+	}
+	if res.chunk == "" {
+		return chunkMove{}, false
+	}
+
+	ch := fsData.Chunks[res.chunk]
+	res.from = from
+	res.data.Checksum = ch.Checksum
+	res.data.Tags = make(helper.TagsSet)
+	for tag, nums := range ch.Tags {
+		res.data.Tags[tag] = append([]uint64{}, nums...)
+	}
+	return res, true
+}
+
+// pickChunk returns the largest chunk of at most limit bytes, which
+// may be moved between the slaves.
+func (self *FsData) pickChunk(from, to string, limit uint64, skip IdSet) (string, uint64) {
+	res := ""
+	var size uint64 = 0
+	for chunk, ch := range self.slaves[from].Chunks {
+		if ch.Size == 0 || ch.Size > limit || skip[chunk] || !self.movable(from, chunk) || !self.hasSpace(to, ch.Size) {
+			continue
+		}
+		if target, ok := self.slaves[to]; ok {
+			if _, ok := target.Chunks[chunk]; ok {
+				continue
+			}
+		}
+		if self.rackTaken(chunk, to, from) {
+			continue
+		}
+		if ch.Size > size || (ch.Size == size && chunk < res) {
+			res = chunk
+			size = ch.Size
+		}
+	}
+	return res, size
+}
+
+// Balancer moves chunks from slaves storing more data to the ones storing
+// less, until usage of every slave is within threshold of the average.
+// Moves are throttled to rate bytes per second, 0 means no limit.
+type Balancer struct {
+	master    *Master
+	threshold float64
+	rate      int64
+	interval  time.Duration
+	running   bool
+	lock      sync.Mutex
+}
+
+func (self *Balancer) Run() {
+	for {
+		time.Sleep(self.interval)
+		stats, err := self.Balance()
+		if err != nil {
+			fmt.Println("Error balance:", err)
+		} else if stats.Chunks != 0 {
+			fmt.Println("Balance: moved", stats.Chunks, "chunks,", stats.Bytes, "bytes")
+		}
+	}
+}
+
+func (self *Balancer) start() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.running {
+		return false
+	}
+	self.running = true
+	return true
+}
+
+func (self *Balancer) finish() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.running = false
+}
+
+// liveSlaves returns ids of the slaves, which have fileservers
+// and are not draining.
+func (self *Master) liveSlaves() []string {
+	self.lock.Lock()
+	ids := []string{}
+	for id, slave := range self.slaves {
+		if slave.fileserver != "" {
+			ids = append(ids, id)
+		}
+	}
+	self.lock.Unlock()
+
+	res := []string{}
+	for _, id := range ids {
+		if !self.fsdata.IsDraining(id) {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// throttle sleeps until the bytes sent since started fit in the rate.
+func (self *Balancer) throttle(bytes uint64, started time.Time) {
+	if self.rate > 0 {
+		spent := time.Duration(float64(bytes) / float64(self.rate) * float64(time.Second))
+		time.Sleep(spent - time.Since(started))
+	}
+}
+
+// Balance moves chunks one by one. Chunks failed to move are skipped
+// until the next run.
+func (self *Balancer) Balance() (hipstmr.BalanceStats, error) {
+	res := hipstmr.BalanceStats{}
+	if !self.start() {
+		return res, errors.New("Balancing is already running.")
+	}
+	defer self.finish()
+
+	skip := make(IdSet)
+	for {
+		move, ok := self.master.fsdata.planMove(self.master.liveSlaves(), self.threshold, skip)
+		if !ok {
+			return res, nil
+		}
+
+		started := time.Now()
+		if err := self.master.moveChunk(move); err != nil {
+			fmt.Println("Error balance: failed to move chunk", move.chunk, "from slave", move.from, "to slave", move.to+":", err)
+			skip[move.chunk] = true
+			continue
+		}
+		fmt.Println("Moved chunk", move.chunk, "from slave", move.from, "to slave", move.to)
+		res.Chunks++
+		res.Bytes += move.data.Size
+		self.throttle(move.data.Size, started)
+	}
+}
+
+// moveChunk copies the file of the chunk by fileservers and then moves
+// the chunk in the metadata. The source file is removed with the chunk on
+// commit, the copied one is left to garbage collection otherwise.
+// Tables of the chunk are locked, so nobody starts reading it meanwhile.
+func (self *Master) moveChunk(move chunkMove) error {
+	tables := move.tables()
+	id := uuid.New()
+	if err := self.locks.Lock(id, "balance", nil, tables, false, nil); err != nil {
+		return err
+	}
+	defer self.locks.Unlock(id)
+
+	slaves, err := self.getSlaves([]string{move.from, move.to})
+	if err != nil {
+		return err
+	}
+
+	if err := copyChunk(slaves[0].fileserver, slaves[1].fileserver, move.chunk, move.data.Checksum); err != nil {
+		return err
+	}
+
+	chunks := map[string]helper.ChunkData{
+		move.chunk: move.data,
+	}
+	return self.RunTwoPhase(map[string][]helper.Step{
+		move.to: self.addChunkSteps(move),
+		move.from: {
+			{
+				Action: "fs_del_chunks",
+				Params: helper.Params{
+					Params: &hipstmr.Params{
+						InputTables: tables,
+					},
+					ChunksData: chunks,
+				},
+			},
+		},
+	})
+}
+
+// addChunkSteps adds the chunk to the slave it is moved or copied to.
+// Expiration times of its tables are set there too.
+func (self *Master) addChunkSteps(move chunkMove) []helper.Step {
+	res := []helper.Step{
+		{
+			Action: "fs_add_chunks",
+			Params: helper.Params{
+				Params: &hipstmr.Params{},
+				ChunksData: map[string]helper.ChunkData{
+					move.chunk: move.data,
+				},
+			},
+		},
+	}
+	for _, tbl := range move.tables() {
+		if expires := self.fsdata.GetExpires(tbl); expires != 0 {
+			res = append(res, helper.Step{
+				Action: "fs_set_expire",
+				Params: helper.Params{
+					Params: &hipstmr.Params{
+						InputTables: []string{tbl},
+					},
+					Expires: expires,
+				},
+			})
+		}
+	}
+	return res
+}
+
+func NewBalancer(master *Master, threshold float64, rate int64, interval time.Duration) *Balancer {
+	return &Balancer{
+		master:    master,
+		threshold: threshold,
+		rate:      rate,
+		interval:  interval,
+	}
+}
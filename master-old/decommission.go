@@ -0,0 +1,315 @@
+package main
+
+import (
+	"HipstMR/helper"
+	"HipstMR/lib/go/hipstmr"
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const decommissionCheckInterval = 5 * time.Second
+
+// SetDraining makes the slave avoided for reading chunks, which have
+// replicas elsewhere.
+func (self *FsData) SetDraining(id string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.draining[id] = true
+}
+
+func (self *FsData) IsDraining(id string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.draining[id]
+}
+
+// findLiveReplica returns another slave, which has a healthy copy
+// of the chunk and isn't draining.
+func (self *FsData) findLiveReplica(id, chunk string) (string, bool) {
+	for slave, fsData := range self.slaves {
+		if slave == id || self.bad[slave][chunk] || self.draining[slave] {
+			continue
+		}
+		if _, ok := fsData.Chunks[chunk]; ok {
+			return slave, true
+		}
+	}
+	return "", false
+}
+
+// preferLive drops draining and full slaves from the list, unless there
+// are no others.
+func (self *FsData) preferLive(slaves []string) []string {
+	res := []string{}
+	for _, slave := range slaves {
+		if !self.draining[slave] && !self.full(slave) {
+			res = append(res, slave)
+		}
+	}
+	if len(res) == 0 {
+		return slaves
+	}
+	return res
+}
+
+// planCopies picks the least used of the targets with space for every
+// chunk of the slave, which has no healthy replica on a slave not draining.
+// Targets in racks without replicas of the chunk are preferred.
+// Temporary chunks of finishing operations are left for later, bad ones
+// without replicas are lost.
+func (self *FsData) planCopies(id string, targets []string) ([]chunkMove, int, int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	usage := make(map[string]uint64)
+	available := make(map[string]uint64)
+	for _, target := range targets {
+		usage[target] = self.used(target)
+		if bytes, ok := self.available[target]; ok {
+			available[target] = bytes
+		}
+	}
+
+	res := []chunkMove{}
+	later, lost := 0, 0
+	fsData, ok := self.slaves[id]
+	if !ok {
+		return res, later, lost
+	}
+	for chunk, ch := range fsData.Chunks {
+		if _, ok := self.findLiveReplica(id, chunk); ok {
+			continue
+		}
+		if self.bad[id][chunk] {
+			lost++
+			continue
+		}
+
+		temporary := false
+		for tag, _ := range ch.Tags {
+			if strings.HasPrefix(tag, "tmp/") {
+				temporary = true
+			}
+		}
+		to := ""
+		for _, spread := range []bool{true, false} {
+			for _, target := range targets {
+				if _, ok := self.slaves[target].Chunks[chunk]; ok {
+					continue
+				}
+				if bytes, ok := available[target]; ok && (bytes == 0 || bytes < ch.Size) {
+					continue
+				}
+				if spread && self.rackTaken(chunk, target, id) {
+					continue
+				}
+				if to == "" || usage[target] < usage[to] {
+					to = target
+				}
+			}
+			if to != "" {
+				break
+			}
+		}
+		if temporary || to == "" {
+			later++
+			continue
+		}
+
+		move := chunkMove{
+			from:  id,
+			to:    to,
+			chunk: chunk,
+			data: helper.ChunkData{
+				Size:     ch.Size,
+				Checksum: ch.Checksum,
+				Tags:     make(helper.TagsSet),
+			},
+		}
+		for tag, nums := range ch.Tags {
+			move.data.Tags[tag] = append([]uint64{}, nums...)
+		}
+		usage[to] += ch.Size
+		if _, ok := available[to]; ok {
+			available[to] -= ch.Size
+		}
+		res = append(res, move)
+	}
+	return res, later, lost
+}
+
+func (self *Slave) setDecommission(status hipstmr.DecommissionStatus) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.decommission = &status
+}
+
+// startDecommission returns false, if the slave is already retired.
+func (self *Slave) startDecommission() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.decommission != nil {
+		return false
+	}
+	self.decommission = &hipstmr.DecommissionStatus{
+		State:   "draining",
+		Started: time.Now().Unix(),
+	}
+	return true
+}
+
+func (self *Slave) getDecommission() *hipstmr.DecommissionStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.decommission == nil {
+		return nil
+	}
+	res := *self.decommission
+	return &res
+}
+
+// findSlaves returns connected slaves with the id, of the machine,
+// or with fileservers on the host.
+func (self *Master) findSlaves(name string) []*Slave {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := []*Slave{}
+	for id, slave := range self.slaves {
+		host, _, err := net.SplitHostPort(slave.fileserver)
+		if id == name || slave.machine == name || (err == nil && host == name) {
+			res = append(res, slave)
+		}
+	}
+	return res
+}
+
+// Decommission starts retiring of the slaves and returns their ids.
+func (self *Master) Decommission(name string) ([]string, error) {
+	slaves := self.findSlaves(name)
+	if len(slaves) == 0 {
+		return nil, errors.New("No slave or host " + name + ".")
+	}
+
+	res := []string{}
+	for _, slave := range slaves {
+		if slave.fileserver == "" {
+			return nil, errors.New("Slave " + slave.id + " has no fileserver to copy chunks from.")
+		}
+		if slave.startDecommission() {
+			self.fsdata.SetDraining(slave.id)
+			go self.decommission(slave)
+		}
+		res = append(res, slave.id)
+	}
+	return res, nil
+}
+
+// decommission waits for tasks running on the slave, then copies its
+// chunks to other slaves until every chunk has a replica elsewhere and
+// no tasks are running. It fails, if the slave disconnects meanwhile.
+// The slave is never used again, even if it is not removed.
+func (self *Master) decommission(slave *Slave) {
+	status := *slave.getDecommission()
+	for {
+		status.Jobs = slave.runningJobs()
+		slave.setDecommission(status)
+		if status.Jobs == 0 {
+			break
+		}
+		time.Sleep(decommissionCheckInterval)
+	}
+
+	status.State = "copying"
+	for {
+		if _, err := self.getSlaves([]string{slave.id}); err != nil {
+			fmt.Println("Error decommission:", err)
+			status.State = "failed"
+			status.Error = err.Error()
+			status.Finished = time.Now().Unix()
+			slave.setDecommission(status)
+			return
+		}
+
+		// tasks, which were started before draining, may still add chunks,
+		// so they are counted before looking for chunks to copy
+		status.Jobs = slave.runningJobs()
+		moves, later, lost := self.fsdata.planCopies(slave.id, self.liveSlaves())
+		status.Chunks = len(moves) + later + lost
+		status.Error = ""
+		if lost != 0 {
+			status.Error = fmt.Sprintf("%d chunks have no healthy copies.", lost)
+		}
+		slave.setDecommission(status)
+		if status.Chunks == 0 && status.Jobs == 0 {
+			break
+		}
+
+		copied := false
+		for _, move := range moves {
+			started := time.Now()
+			if err := self.replicateChunk(move); err != nil {
+				fmt.Println("Error decommission: failed to copy chunk", move.chunk, "from slave", move.from, "to slave", move.to+":", err)
+				status.Error = err.Error()
+				slave.setDecommission(status)
+				continue
+			}
+			copied = true
+			status.Chunks--
+			status.Copied++
+			status.Bytes += move.data.Size
+			slave.setDecommission(status)
+			self.balancer.throttle(move.data.Size, started)
+		}
+		if !copied {
+			time.Sleep(decommissionCheckInterval)
+		}
+	}
+
+	status.State = "done"
+	status.Finished = time.Now().Unix()
+	slave.setDecommission(status)
+	fmt.Println("Slave", slave.id, "is decommissioned, it is safe to remove")
+}
+
+// replicateChunk copies the file of the chunk by fileservers and then
+// adds the chunk to the metadata of the other slave, if its tables were
+// not changed meanwhile. The copied file is left to garbage collection
+// otherwise.
+func (self *Master) replicateChunk(move chunkMove) error {
+	tables := move.tables()
+	id := uuid.New()
+	if err := self.locks.Lock(id, "decommission", tables, nil, false, nil); err != nil {
+		return err
+	}
+	defer self.locks.Unlock(id)
+
+	slaves, err := self.getSlaves([]string{move.from, move.to})
+	if err != nil {
+		return err
+	}
+
+	if err := copyChunk(slaves[0].fileserver, slaves[1].fileserver, move.chunk, move.data.Checksum); err != nil {
+		return err
+	}
+
+	return self.RunTwoPhase(map[string][]helper.Step{
+		move.to: self.addChunkSteps(move),
+		move.from: {
+			{
+				Action: "fs_check_chunks",
+				Params: helper.Params{
+					Params: &hipstmr.Params{},
+					ChunksData: map[string]helper.ChunkData{
+						move.chunk: move.data,
+					},
+				},
+			},
+		},
+	})
+}
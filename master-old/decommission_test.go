@@ -0,0 +1,21 @@
+package main
+
+import (
+	"HipstMR/helper"
+	"testing"
+)
+
+func TestDecommissionFailsOnDisconnect(t *testing.T) {
+	master := NewMaster("", 0)
+	slave := NewSlave(&master, nil, nil, helper.SlaveInfo{})
+	if !slave.startDecommission() {
+		t.Fatal("decommission is not started")
+	}
+
+	// the slave is already gone, so nothing can be copied from it
+	master.decommission(slave)
+	status := slave.getDecommission()
+	if status.State != "failed" || status.Error == "" || status.Finished == 0 {
+		t.Fatalf("decommission of the disconnected slave ended with %+v", *status)
+	}
+}
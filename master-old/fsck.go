@@ -0,0 +1,151 @@
+package main
+
+import (
+	"HipstMR/helper"
+	"HipstMR/lib/go/hipstmr"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func (self *Master) setActive(id string, active bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if active {
+		self.active[id] = true
+	} else {
+		delete(self.active, id)
+	}
+}
+
+// CheckTables finds different chunks with the same number and missing
+// numbers in tables across all the slaves. Tables may start with any number.
+func (self *FsData) CheckTables() []hipstmr.FsckIssue {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	tables := make([]string, 0, len(self.index))
+	for tbl, _ := range self.index {
+		if !strings.HasPrefix(tbl, "tmp/") && !strings.HasPrefix(tbl, pinPrefix) {
+			tables = append(tables, tbl)
+		}
+	}
+	sort.Strings(tables)
+
+	res := []hipstmr.FsckIssue{}
+	for _, tbl := range tables {
+		// replicas of a chunk are the same chunk
+		nums := make(map[uint64]IdSet)
+		var first, next uint64 = 0, 0
+		for slave, chunks := range self.index[tbl] {
+			for chunk, _ := range chunks {
+				for _, n := range self.slaves[slave].Chunks[chunk].Tags[tbl] {
+					if nums[n] == nil {
+						nums[n] = make(IdSet)
+					}
+					nums[n][chunk] = true
+					if len(nums) == 1 || n < first {
+						first = n
+					}
+					if n >= next {
+						next = n + 1
+					}
+				}
+			}
+		}
+
+		for n := first; n < next; n++ {
+			if len(nums[n]) > 1 {
+				chunks := []string{}
+				for chunk, _ := range nums[n] {
+					chunks = append(chunks, chunk)
+				}
+				sort.Strings(chunks)
+				res = append(res, hipstmr.FsckIssue{
+					Kind:    "duplicate",
+					Table:   tbl,
+					Num:     n,
+					Details: "chunks " + strings.Join(chunks, ", "),
+				})
+			} else if len(nums[n]) == 0 {
+				from := n
+				for n+1 < next && len(nums[n+1]) == 0 {
+					n++
+				}
+				res = append(res, hipstmr.FsckIssue{
+					Kind:    "gap",
+					Table:   tbl,
+					Num:     from,
+					Details: fmt.Sprintf("chunks %d-%d are missing", from, n),
+				})
+			}
+		}
+	}
+	return res
+}
+
+// Fsck checks chunks on all the slaves and tables in the index. Lost and
+// damaged chunks are copied from replicas in repair mode.
+func (self *Master) Fsck(repair bool) (hipstmr.FsckReport, error) {
+	self.lock.Lock()
+	slaves := make([]*Slave, 0, len(self.slaves))
+	for _, slave := range self.slaves {
+		slaves = append(slaves, slave)
+	}
+	self.lock.Unlock()
+	active := self.activeTransactions()
+
+	tasks := make([]slaveTask, len(slaves))
+	for i, slave := range slaves {
+		tr := helper.NewTransaction("fsck")
+		tr.Params.Repair = repair
+		tr.Params.Active = active
+		tasks[i] = slaveTask{
+			slave: slave,
+			task: Task{
+				trans:  tr,
+				signal: make(chan helper.Transaction),
+			},
+		}
+	}
+
+	report := hipstmr.FsckReport{
+		Issues: []hipstmr.FsckIssue{},
+	}
+	for i, tr := range self.RunTransactionSimple(tasks) {
+		slave := slaves[i]
+		if tr.Status != "finished" {
+			return report, errors.New("Slave " + slave.id + " failed to check its chunks.")
+		}
+
+		var issues []hipstmr.FsckIssue
+		if err := helper.DecodePayload(tr.Payload, &issues); err != nil {
+			return report, err
+		}
+
+		for j, issue := range issues {
+			issues[j].Slave = slave.id
+			if !repair || (issue.Kind != "missing" && issue.Kind != "size") {
+				continue
+			}
+
+			self.fsdata.MarkBad(slave.id, []string{issue.Chunk}, false)
+			if !self.startRepair(slave, issue.Chunk) {
+				// the scrubber has found it already
+				continue
+			}
+			if err := self.repairChunk(slave, issue.Chunk); err != nil {
+				fmt.Println("Error fsck:", err)
+			} else {
+				self.fsdata.ClearBad(slave.id, issue.Chunk)
+				issues[j].Repaired = true
+			}
+			self.finishRepair(slave, issue.Chunk)
+		}
+		report.Issues = append(report.Issues, issues...)
+	}
+
+	report.Issues = append(report.Issues, self.fsdata.CheckTables()...)
+	return report, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"HipstMR/helper"
+	"HipstMR/lib/go/hipstmr"
+	"fmt"
+)
+
+// activeTransactions returns ids of transactions, whose temporary data
+// slaves must keep.
+func (self *Master) activeTransactions() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := make([]string, 0, len(self.active))
+	for id, _ := range self.active {
+		res = append(res, id)
+	}
+	return res
+}
+
+func (self *Slave) setGc(status hipstmr.GcStatus) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.gc = status
+}
+
+func (self *Slave) getGc() hipstmr.GcStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.gc
+}
+
+// OnGcQuery tells the slave which transactions are active, everything
+// else is either finished or dead.
+func (self *Master) OnGcQuery(slave *Slave, trans helper.Transaction) error {
+	trans.Params.Active = self.activeTransactions()
+	trans.Status = "finished"
+	return slave.Send(trans)
+}
+
+func (self *Master) OnGcReport(slave *Slave, trans helper.Transaction) error {
+	var status hipstmr.GcStatus
+	if err := helper.DecodePayload(trans.Payload, &status); err != nil {
+		return err
+	}
+	slave.setGc(status)
+
+	if status.DryRun || status.LastRun.Tables == 0 {
+		return nil
+	}
+
+	// dropped temporary tables are not in the index yet
+	go func() {
+		if err := self.UpdateFs(slave); err != nil {
+			fmt.Println("Error gc report:", err)
+		}
+	}()
+	return nil
+}
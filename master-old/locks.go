@@ -0,0 +1,311 @@
+package main
+
+import (
+	"HipstMR/lib/go/hipstmr"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+type tableLock struct {
+	exclusive string
+	shared    IdSet
+}
+
+type lockHolder struct {
+	typ    string
+	since  int64
+	tables []string
+}
+
+// LockManager keeps shared and exclusive locks of tables. A transaction
+// takes all its locks at once and holds them till the end, so transactions
+// never deadlock waiting for each other. Waiting exclusive requests are
+// queued, later requests for their tables wait for them, so a stream of
+// shared locks can't starve them.
+type LockManager struct {
+	tables  map[string]*tableLock
+	holders map[string]*lockHolder
+	queued  map[string]map[string]uint64
+	seq     uint64
+	timeout time.Duration
+	lock    sync.Mutex
+	cond    *sync.Cond
+}
+
+// conflict returns the transaction, which prevents locking the table
+// by the request with the ticket.
+func (self *LockManager) conflict(id, tbl string, exclusive bool, ticket uint64) string {
+	for waiter, t := range self.queued[tbl] {
+		if waiter != id && t < ticket {
+			return waiter
+		}
+	}
+
+	l, ok := self.tables[tbl]
+	if !ok {
+		return ""
+	}
+	if l.exclusive != "" && l.exclusive != id {
+		return l.exclusive
+	}
+	if exclusive {
+		for holder, _ := range l.shared {
+			if holder != id {
+				return holder
+			}
+		}
+	}
+	return ""
+}
+
+func (self *LockManager) enqueue(id string, tables IdSet, ticket uint64) {
+	for tbl, _ := range tables {
+		if self.queued[tbl] == nil {
+			self.queued[tbl] = make(map[string]uint64)
+		}
+		self.queued[tbl][id] = ticket
+	}
+}
+
+func (self *LockManager) dequeue(id string, tables IdSet) {
+	for tbl, _ := range tables {
+		delete(self.queued[tbl], id)
+		if len(self.queued[tbl]) == 0 {
+			delete(self.queued, tbl)
+		}
+	}
+	self.cond.Broadcast()
+}
+
+// wake wakes up waiters at the deadline or on cancel, so they give up.
+func (self *LockManager) wake(deadline time.Time, cancel, done <-chan struct{}) {
+	var timeout <-chan time.Time = nil
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-timeout:
+	case <-cancel:
+	case <-done:
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.cond.Broadcast()
+}
+
+// Lock takes the locks for the transaction, exclusive ones win over shared
+// ones for the same table. Without wait locked tables are an error. Waiting
+// fails after the timeout of the manager or once cancel is closed.
+func (self *LockManager) Lock(id, typ string, shared, exclusive []string, wait bool, cancel <-chan struct{}) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.seq++
+	ticket := self.seq
+	var deadline time.Time
+	if self.timeout > 0 {
+		deadline = time.Now().Add(self.timeout)
+	}
+
+	excl := make(IdSet)
+	for _, tbl := range exclusive {
+		excl[tbl] = true
+	}
+
+	var done chan struct{} = nil
+	defer func() {
+		if done != nil {
+			close(done)
+			self.dequeue(id, excl)
+		}
+	}()
+
+	for {
+		holder, table := "", ""
+		for tbl, _ := range excl {
+			if holder = self.conflict(id, tbl, true, ticket); holder != "" {
+				table = tbl
+				break
+			}
+		}
+		for _, tbl := range shared {
+			if holder != "" {
+				break
+			}
+			if holder = self.conflict(id, tbl, false, ticket); holder != "" {
+				table = tbl
+			}
+		}
+
+		if holder == "" {
+			break
+		}
+		if !wait {
+			return errors.New("Table " + table + " is locked by transaction " + holder + ".")
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return errors.New("Timed out waiting for table " + table + " locked by transaction " + holder + ".")
+		}
+		select {
+		case <-cancel:
+			return errors.New("Stopped waiting for table " + table + " locked by transaction " + holder + ".")
+		default:
+		}
+
+		if done == nil {
+			done = make(chan struct{})
+			self.enqueue(id, excl, ticket)
+			go self.wake(deadline, cancel, done)
+		}
+		self.cond.Wait()
+	}
+
+	h, ok := self.holders[id]
+	if !ok {
+		h = &lockHolder{
+			typ:   typ,
+			since: time.Now().Unix(),
+		}
+		self.holders[id] = h
+	}
+	take := func(tbl string) *tableLock {
+		l, ok := self.tables[tbl]
+		if !ok {
+			l = &tableLock{
+				shared: make(IdSet),
+			}
+			self.tables[tbl] = l
+		}
+		h.tables = append(h.tables, tbl)
+		return l
+	}
+	for tbl, _ := range excl {
+		take(tbl).exclusive = id
+	}
+	for _, tbl := range shared {
+		if !excl[tbl] {
+			take(tbl).shared[id] = true
+		}
+	}
+	return nil
+}
+
+// Unlock releases all the locks of the transaction.
+func (self *LockManager) Unlock(id string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	h, ok := self.holders[id]
+	if !ok {
+		return
+	}
+	for _, tbl := range h.tables {
+		l, ok := self.tables[tbl]
+		if !ok {
+			continue
+		}
+		if l.exclusive == id {
+			l.exclusive = ""
+		}
+		delete(l.shared, id)
+		if l.exclusive == "" && len(l.shared) == 0 {
+			delete(self.tables, tbl)
+		}
+	}
+	delete(self.holders, id)
+	self.cond.Broadcast()
+}
+
+func (self *LockManager) List() []hipstmr.LockInfo {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := []hipstmr.LockInfo{}
+	add := func(tbl, mode, id string) {
+		h := self.holders[id]
+		res = append(res, hipstmr.LockInfo{
+			Table:       tbl,
+			Mode:        mode,
+			Transaction: id,
+			Type:        h.typ,
+			Since:       h.since,
+		})
+	}
+	for tbl, l := range self.tables {
+		if l.exclusive != "" {
+			add(tbl, "exclusive", l.exclusive)
+		}
+		for id, _ := range l.shared {
+			add(tbl, "shared", id)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Table != res[j].Table {
+			return res[i].Table < res[j].Table
+		}
+		return res[i].Transaction < res[j].Transaction
+	})
+	return res
+}
+
+// NewLockManager makes a manager, which fails waiting for locks after
+// the timeout, zero means no timeout.
+func NewLockManager(timeout time.Duration) *LockManager {
+	res := &LockManager{
+		tables:  make(map[string]*tableLock),
+		holders: make(map[string]*lockHolder),
+		queued:  make(map[string]map[string]uint64),
+		timeout: timeout,
+	}
+	res.cond = sync.NewCond(&res.lock)
+	return res
+}
+
+// writtenTables returns tables, which the step changes.
+func writtenTables(p *hipstmr.Params) []string {
+	res := append([]string{}, p.OutputTables...)
+	if p.Type == "move" || p.Type == "drop" {
+		res = append(res, p.InputTables...)
+	}
+	for _, step := range p.Steps {
+		res = append(res, writtenTables(step)...)
+	}
+	return res
+}
+
+func readTables(p *hipstmr.Params) []string {
+	res := append([]string{}, p.InputTables...)
+	for _, step := range p.Steps {
+		res = append(res, readTables(step)...)
+	}
+	return res
+}
+
+// lockedTables returns tables the client operation locks shared
+// and exclusively. Maps read pinned versions of their inputs, which
+// are locked only while pinned.
+func lockedTables(p *hipstmr.Params) ([]string, []string) {
+	switch p.Type {
+	case "map":
+		return nil, p.OutputTables
+	case "move", "copy", "drop", "transaction":
+		return readTables(p), writtenTables(p)
+	case "undrop", "set_ttl", "merge":
+		return nil, p.InputTables
+	case "snapshot":
+		if len(p.InputTables) == 1 {
+			return p.InputTables, []string{hipstmr.SnapshotTable(p.InputTables[0], p.Name)}
+		}
+	case "drop_snapshot":
+		if len(p.InputTables) == 1 {
+			return nil, []string{hipstmr.SnapshotTable(p.InputTables[0], p.Name)}
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func lockAsync(locks *LockManager, id string, shared, exclusive []string, cancel <-chan struct{}) chan error {
+	res := make(chan error, 1)
+	go func() {
+		res <- locks.Lock(id, "test", shared, exclusive, true, cancel)
+	}()
+	return res
+}
+
+func expectBlocked(t *testing.T, ch chan error, what string) {
+	select {
+	case err := <-ch:
+		t.Fatalf("%s is not blocked: %v", what, err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func expectLocked(t *testing.T, ch chan error, what string) {
+	select {
+	case err := <-ch:
+		if err != nil {
+			t.Fatalf("%s failed: %v", what, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("%s is still blocked", what)
+	}
+}
+
+func TestLockQueuedExclusiveWinsOverLaterShared(t *testing.T) {
+	locks := NewLockManager(0)
+	if err := locks.Lock("r1", "test", []string{"t"}, nil, true, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w := lockAsync(locks, "w", nil, []string{"t"}, nil)
+	expectBlocked(t, w, "writer")
+
+	// readers coming after the writer wait for it
+	r2 := lockAsync(locks, "r2", []string{"t"}, nil, nil)
+	expectBlocked(t, r2, "later reader")
+	if err := locks.Lock("r3", "test", []string{"t"}, nil, false, nil); err == nil {
+		t.Fatal("later reader without wait got the lock")
+	}
+
+	locks.Unlock("r1")
+	expectLocked(t, w, "writer")
+	expectBlocked(t, r2, "later reader")
+
+	locks.Unlock("w")
+	expectLocked(t, r2, "later reader")
+	locks.Unlock("r2")
+}
+
+func TestLockTimeout(t *testing.T) {
+	locks := NewLockManager(50 * time.Millisecond)
+	if err := locks.Lock("r", "test", []string{"t"}, nil, true, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w := lockAsync(locks, "w", nil, []string{"t"}, nil)
+	select {
+	case err := <-w:
+		if err == nil {
+			t.Fatal("writer got the lock held by the reader")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("writer doesn't time out")
+	}
+
+	// the writer gave up, so it doesn't hold back readers anymore
+	if err := locks.Lock("r2", "test", []string{"t"}, nil, false, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockCancel(t *testing.T) {
+	locks := NewLockManager(0)
+	if err := locks.Lock("w1", "test", nil, []string{"t"}, true, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel := make(chan struct{})
+	w2 := lockAsync(locks, "w2", nil, []string{"t"}, cancel)
+	expectBlocked(t, w2, "second writer")
+	close(cancel)
+	select {
+	case err := <-w2:
+		if err == nil {
+			t.Fatal("cancelled writer got the lock")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancelled writer still waits")
+	}
+
+	locks.Unlock("w1")
+	if len(locks.List()) != 0 {
+		t.Fatal("locks are left:", locks.List())
+	}
+}
@@ -12,6 +12,10 @@ import (
 	"fmt"
 	"net"
 	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 
@@ -19,50 +23,152 @@ func Failed(trans helper.Transaction, conn net.Conn, origErr error) {
 	trans.Params.Params = nil
 	trans.Params.Chunks = nil
 	trans.Params.OutputTables = nil
-	trans.Payload = nil
+	trans.Payload = origErr.Error()
 	trans.Status = "failed"
 	if err := trans.Send(conn); err != nil {
 		fmt.Println("Errors:", origErr, err)
 	}
 }
 
-type IdSet []string
+type IdSet map[string]bool
 type TagData map[string]IdSet
 
 type FsData struct {
-	slaves map[string]helper.FsData
-	index  map[string]TagData
-}
-
-func (self *FsData) Rebuild() {
-	self.index = make(map[string]TagData)
-	for slave, fsData := range self.slaves {
-		for chunkId, chunkData := range fsData.Chunks {
-			for tag, _ := range chunkData.Tags {
-				_, ok := self.index[tag]
-				if !ok {
-					self.index[tag] = TagData{
-						slave: IdSet{chunkId},
-					}
-				} else {
-					self.index[tag][slave] = append(self.index[tag][slave], chunkId)
-				}
-			}
+	slaves    map[string]*helper.FsData
+	index     map[string]TagData
+	bad       map[string]IdSet
+	draining  IdSet
+	available map[string]uint64
+	racks     map[string]string
+	lock      sync.Mutex
+}
+
+func (self *FsData) indexChunk(slave, chunk string) {
+	data, ok := self.slaves[slave].Chunks[chunk]
+	if !ok {
+		return
+	}
+
+	for tag, _ := range data.Tags {
+		tagData, ok := self.index[tag]
+		if !ok {
+			tagData = make(TagData)
+			self.index[tag] = tagData
+		}
+
+		ids, ok := tagData[slave]
+		if !ok {
+			ids = make(IdSet)
+			tagData[slave] = ids
 		}
+		ids[chunk] = true
 	}
 }
 
-func (self *FsData) Update(id string, slave helper.FsData) {
-	self.slaves[id] = slave
-	self.Rebuild()
+func (self *FsData) unindexChunk(slave, chunk string) {
+	data, ok := self.slaves[slave].Chunks[chunk]
+	if !ok {
+		return
+	}
+
+	for tag, _ := range data.Tags {
+		tagData, ok := self.index[tag]
+		if !ok {
+			continue
+		}
+
+		delete(tagData[slave], chunk)
+		if len(tagData[slave]) == 0 {
+			delete(tagData, slave)
+		}
+		if len(tagData) == 0 {
+			delete(self.index, tag)
+		}
+	}
 }
 
-func (self *FsData) Unlink(slave Slave) {
-	delete(self.slaves, slave.id)
-	self.Rebuild()
+// Update applies changes of slave's metadata to the index. Only chunks
+// touched by the delta are reindexed, unless it is the whole metadata.
+func (self *FsData) Update(id string, delta helper.Delta) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	fsData, ok := self.slaves[id]
+	if !ok || delta.Full {
+		self.unlink(id)
+		fsData = &helper.FsData{}
+		if err := fsData.ApplyDelta(delta); err != nil {
+			return err
+		}
+
+		self.slaves[id] = fsData
+		for chunk, _ := range fsData.Chunks {
+			self.indexChunk(id, chunk)
+		}
+		return nil
+	}
+
+	if delta.From != fsData.Seq {
+		return errors.New(fmt.Sprintf("Delta from %d doesn't match seq %d of slave %s.", delta.From, fsData.Seq, id))
+	}
+
+	touched := make(map[string]bool)
+	for _, m := range delta.Mutations {
+		touched[m.Chunk] = true
+	}
+
+	for chunk, _ := range touched {
+		self.unindexChunk(id, chunk)
+	}
+	if err := fsData.ApplyDelta(delta); err != nil {
+		return err
+	}
+	for chunk, _ := range touched {
+		self.indexChunk(id, chunk)
+	}
+	return nil
+}
+
+// GetSeq returns the version of slave's metadata known to the master.
+func (self *FsData) GetSeq(id string) uint64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	fsData, ok := self.slaves[id]
+	if !ok {
+		return 0
+	}
+	return fsData.Seq
+}
+
+// Unlink forgets the disconnected slave. State of the slave, which isn't
+// in its metadata, survives reloads of the metadata by unlink.
+func (self *FsData) Unlink(id string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.unlink(id)
+	delete(self.draining, id)
+	delete(self.available, id)
+	delete(self.racks, id)
+}
+
+func (self *FsData) unlink(id string) {
+	fsData, ok := self.slaves[id]
+	if !ok {
+		return
+	}
+
+	for chunk, _ := range fsData.Chunks {
+		self.unindexChunk(id, chunk)
+	}
+	delete(self.slaves, id)
+	delete(self.bad, id)
 }
 
 func (self *FsData) GetTablesOwners(tbls []string) []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
 	slaves := make(map[string]bool)
 	for _, tbl := range tbls {
 		val, ok := self.index[tbl]
@@ -82,122 +188,408 @@ func (self *FsData) GetTablesOwners(tbls []string) []string {
 }
 
 func (self *FsData) GetTablesOwnersChunks(tbls []string) map[string][]string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
 	slaves := make(map[string][]string)
 	for _, tbl := range tbls {
 		val, ok := self.index[tbl]
 		if ok {
-			for slave, chunks := range val {
-				slaves[slave] = append(slaves[slave], chunks...)
+			for slave, _ := range val {
+				slaves[slave] = append(slaves[slave], self.slaves[slave].TagChunks(tbl)...)
 			}
 		}
 	}
 	return slaves
 }
 
+// GetInputChunks chooses slaves to read chunks of the tables from,
+// bad chunks are read from their healthy replicas. Chunks of draining
+// and full slaves are read from other replicas if there are any.
+// Only allowed slaves are chosen, unless it is nil.
+func (self *FsData) GetInputChunks(tbls []string, allowed IdSet) (map[string][]string, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	slaves := make(map[string][]string)
+	for _, tbl := range tbls {
+		seen := make(map[string]bool)
+		for slave, _ := range self.index[tbl] {
+			for _, chunk := range self.slaves[slave].TagChunks(tbl) {
+				if seen[chunk] {
+					continue
+				}
+				seen[chunk] = true
+
+				owner := slave
+				unfit := self.draining[slave] || self.full(slave) || (allowed != nil && !allowed[slave])
+				if replica, ok := self.findSpaciousReplica(slave, chunk, allowed); ok && unfit {
+					owner = replica
+				} else if self.bad[slave][chunk] {
+					replica, _, ok := self.findReplica(slave, chunk)
+					if !ok {
+						return nil, errors.New("Chunk " + chunk + " of table " + tbl + " is bad on slave " + slave + " and has no healthy replicas.")
+					}
+					owner = replica
+				}
+				if allowed != nil && !allowed[owner] {
+					return nil, errors.New("Chunk " + chunk + " of table " + tbl + " has no healthy replicas on slaves matching the node selector.")
+				}
+				slaves[owner] = append(slaves[owner], chunk)
+			}
+		}
+	}
+	return slaves, nil
+}
+
+func (self *FsData) NextChunkNum(tbl string) uint64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	var num uint64 = 0
+	for slave, _ := range self.index[tbl] {
+		n := self.slaves[slave].NextChunkNum(tbl)
+		if n > num {
+			num = n
+		}
+	}
+	return num
+}
+
+// numberSteps numbers output chunks of move and copy steps, so chunks
+// of a table spread over several slaves don't get the same numbers and
+// replicas of a chunk get the same one. Tables are followed through
+// the steps, as earlier steps change inputs of later ones.
+func (self *FsData) numberSteps(steps []helper.Step) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	tables := make(map[string]map[string][]uint64)
+	get := func(tbl string) map[string][]uint64 {
+		res, ok := tables[tbl]
+		if !ok {
+			res = make(map[string][]uint64)
+			for slave, chunks := range self.index[tbl] {
+				for chunk, _ := range chunks {
+					res[chunk] = append([]uint64{}, self.slaves[slave].Chunks[chunk].Tags[tbl]...)
+				}
+			}
+			tables[tbl] = res
+		}
+		return res
+	}
+
+	for i := range steps {
+		step := &steps[i]
+		p := step.Params.Params
+		if step.Action == "fs_drop" {
+			for _, in := range p.InputTables {
+				tables[in] = make(map[string][]uint64)
+			}
+			continue
+		}
+		if step.Action != "fs_move" && step.Action != "fs_copy" {
+			continue
+		}
+
+		output := p.OutputTables[0]
+		var num uint64 = 0
+		if p.IsAppend(output) {
+			num = nextNum(get(output))
+		} else {
+			tables[output] = make(map[string][]uint64)
+		}
+
+		added := make(map[string][]uint64)
+		step.Params.Chunks = []string{}
+		step.Params.OutputChunkNums = []uint64{}
+		for _, in := range p.InputTables {
+			for _, chunk := range sortedChunks(get(in)) {
+				step.Params.Chunks = append(step.Params.Chunks, chunk)
+				step.Params.OutputChunkNums = append(step.Params.OutputChunkNums, num)
+				added[chunk] = append(added[chunk], num)
+				num++
+			}
+			if step.Action == "fs_move" {
+				tables[in] = make(map[string][]uint64)
+			}
+		}
+
+		out := get(output)
+		for chunk, nums := range added {
+			out[chunk] = append(out[chunk], nums...)
+		}
+	}
+}
+
+func nextNum(chunks map[string][]uint64) uint64 {
+	var res uint64 = 0
+	for _, nums := range chunks {
+		for _, n := range nums {
+			if n >= res {
+				res = n + 1
+			}
+		}
+	}
+	return res
+}
+
+// sortedChunks orders chunks of a table by their first numbers.
+func sortedChunks(chunks map[string][]uint64) []string {
+	first := make(map[string]uint64, len(chunks))
+	res := make([]string, 0, len(chunks))
+	for chunk, nums := range chunks {
+		for i, n := range nums {
+			if i == 0 || n < first[chunk] {
+				first[chunk] = n
+			}
+		}
+		res = append(res, chunk)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if first[res[i]] != first[res[j]] {
+			return first[res[i]] < first[res[j]]
+		}
+		return res[i] < res[j]
+	})
+	return res
+}
+
 func (self *FsData) UpdateFromTrans(slave *Slave, trans helper.Transaction) error {
-	str := trans.Payload.(string)
+	str, ok := trans.Payload.(string)
+	if !ok {
+		return errors.New("No metadata in transaction " + trans.Id + ".")
+	}
+
 	bs, err := base64.StdEncoding.DecodeString(str)
 	if err != nil {
 		return err
 	}
 
-	var fsdata helper.FsData
-	if err := json.Unmarshal(bs, &fsdata); err != nil {
+	var delta helper.Delta
+	if err := delta.UnmarshalBinary(bs); err != nil {
 		fmt.Println("PT 2", err)
 		return err
 	}
 
-	self.Update(slave.id, fsdata)
-	fmt.Println("Chunks:", self.index)
+	if err := self.Update(slave.id, delta); err != nil {
+		return err
+	}
+	fmt.Println("Updated fs of slave", slave.id)
 	return nil
 }
 
 func NewFsData() FsData {
 	return FsData{
-		slaves: make(map[string]helper.FsData),
+		slaves:    make(map[string]*helper.FsData),
+		index:     make(map[string]TagData),
+		bad:       make(map[string]IdSet),
+		draining:  make(IdSet),
+		available: make(map[string]uint64),
+		racks:     make(map[string]string),
 	}
 }
 
 
 type Slave struct {
-	id string
-	master *Master
-	conn net.Conn
-	decoder *json.Decoder
-	tasks chan Task
+	id           string
+	master       *Master
+	conn         net.Conn
+	decoder      *json.Decoder
+	tasks        chan Task
 	transactions map[string]chan helper.Transaction
+	lost         IdSet
+	closed       bool
+	fileserver   string
+	machine      string
+	rack         string
+	labels       map[string]string
+	scrub        hipstmr.ScrubStatus
+	gc           hipstmr.GcStatus
+	disks        []hipstmr.DiskStatus
+	decommission *hipstmr.DecommissionStatus
+	jobs         int
+	lock         sync.Mutex
+	sendLock     sync.Mutex
 }
 
 func (self *Slave) Failed(trans helper.Transaction, origErr error) {
+	self.sendLock.Lock()
+	defer self.sendLock.Unlock()
 	Failed(trans, self.conn, origErr)
 }
 
-func (self *Slave) sendNewTransaction(trans helper.Transaction, callback func(trans helper.Transaction)) error {
+func (self *Slave) Send(trans helper.Transaction) error {
+	self.sendLock.Lock()
+	defer self.sendLock.Unlock()
+	return trans.Send(self.conn)
+}
+
+func (self *Slave) addTransaction(id string) (chan helper.Transaction, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return nil, errors.New("Slave " + self.id + " is disconnected.")
+	}
 	ch := make(chan helper.Transaction)
-	self.transactions[trans.Id] = ch
-	if err := trans.Send(self.conn); err != nil {
+	self.transactions[id] = ch
+	return ch, nil
+}
+
+func (self *Slave) getTransaction(id string) (chan helper.Transaction, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ch, ok := self.transactions[id]
+	return ch, ok
+}
+
+func (self *Slave) closeTransaction(id string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ch, ok := self.transactions[id]
+	if ok {
+		delete(self.transactions, id)
+		close(ch)
+	}
+}
+
+// failTransactions closes all the running transactions of a disconnected
+// slave, so nobody waits for them forever. Their callbacks get a failed
+// transaction instead of the reply.
+func (self *Slave) failTransactions() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closed = true
+	for id, ch := range self.transactions {
+		delete(self.transactions, id)
+		self.lost[id] = true
+		close(ch)
+	}
+}
+
+// wasLost tells if the transaction was closed by failTransactions.
+func (self *Slave) wasLost(id string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	res := self.lost[id]
+	delete(self.lost, id)
+	return res
+}
+
+func lostTransaction(id string) helper.Transaction {
+	return helper.Transaction{
+		Id:      id,
+		Status:  "failed",
+		Payload: "Slave disconnected.",
+	}
+}
+
+func (self *Slave) sendNewTransaction(trans helper.Transaction, callback func(trans helper.Transaction)) error {
+	ch, err := self.addTransaction(trans.Id)
+	if err != nil {
+		return err
+	}
+	if err := self.Send(trans); err != nil {
+		self.closeTransaction(trans.Id)
 		return err
 	}
 	go func() {
+		done := false
 		for tr := range ch {
+			done = tr.Status == "finished" || failedStatus(tr.Status)
 			callback(tr)
 		}
-		delete(self.transactions, trans.Id)
+		if lost := self.wasLost(trans.Id); lost && !done {
+			callback(lostTransaction(trans.Id))
+		}
 	}()
 	return nil
 }
 
 func (self *Slave) sendNewOnceTransaction(trans helper.Transaction, callback func(trans helper.Transaction)) error {
-	ch := make(chan helper.Transaction)
-	self.transactions[trans.Id] = ch
-	if err := trans.Send(self.conn); err != nil {
+	ch, err := self.addTransaction(trans.Id)
+	if err != nil {
+		return err
+	}
+	if err := self.Send(trans); err != nil {
+		self.closeTransaction(trans.Id)
 		return err
 	}
 	go func() {
-		tr := <-ch
+		tr, ok := <-ch
+		self.closeTransaction(trans.Id)
+		if lost := self.wasLost(trans.Id); lost && !ok {
+			tr = lostTransaction(trans.Id)
+		}
 		callback(tr)
-		close(ch)
-		delete(self.transactions, tr.Id)
 	}()
 	return nil
 }
 
+// addJobs counts map and merge tasks running on the slave.
+func (self *Slave) addJobs(n int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.jobs += n
+}
+
+func (self *Slave) runningJobs() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.jobs
+}
+
 func (self *Slave) RunTasks() {
 	for task := range self.tasks {
 		fmt.Println("Accepted task")
+		signal := task.signal
+		isJob := strings.HasPrefix(task.trans.Action, "mr_")
+		if isJob {
+			self.addJobs(1)
+		}
 		err := self.sendNewTransaction(task.trans, func(msg helper.Transaction) {
 			fmt.Println(msg)
 			if msg.Status == "received_files" {
 				go func() {
-					task.signal <- helper.Transaction{}
+					signal <- helper.Transaction{}
 				}()
 			}
 
-			isDone := msg.Status == "finished" || msg.Status == "failed"
+			isDone := msg.Status == "finished" || failedStatus(msg.Status)
 
 			if isDone {
-				close(self.transactions[msg.Id])
+				self.closeTransaction(msg.Id)
+				if isJob {
+					self.addJobs(-1)
+				}
 			}
 
 			if msg.Status == "finished" {
 				fmt.Println("Finished task")
-				if err := self.master.UpdateFs(self); err != nil {
+				if err := self.master.UpdateFsFromTask(self, msg); err != nil {
 					fmt.Println("Error:", err)
 				}
+			} else if msg.Status == "no_space" {
+				fmt.Println("No space for task on slave "+self.id+":", msg.Payload)
 			} else if msg.Status == "failed" {
-				fmt.Println("Failed task")
+				fmt.Println("Failed task on slave "+self.id+":", msg.Payload)
 			}
 
 			if isDone {
-				task.signal <- msg
+				signal <- msg
 			}
 		})
 
 		if err != nil {
-			fmt.Println("Dropped task")
-			self.Failed(task.trans, err)
-			close(self.tasks) // ?!
-			return
+			fmt.Println("Dropped task:", err)
+			if isJob {
+				self.addJobs(-1)
+			}
+			trans := task.trans
+			trans.Status = "failed"
+			go func() {
+				signal <- trans
+			}()
 		}
 	}
 }
@@ -212,13 +604,18 @@ func (self *Slave) ReadMsg() (helper.Transaction, error) {
 
 func (self *Slave) Run() error {
 	go self.RunTasks()
+	defer self.failTransactions()
 	for {
 		t, err := self.ReadMsg()
 		if err != nil {
 			return err
 		}
 
-		v, ok := self.transactions[t.Id]
+		if self.handleRequest(t) {
+			continue
+		}
+
+		v, ok := self.getTransaction(t.Id)
 		if !ok {
 			return errors.New(fmt.Sprintf("Unknown transaction %s for slave %s.", t.Id, self.id))
 		}
@@ -228,22 +625,62 @@ func (self *Slave) Run() error {
 	return nil
 }
 
-func NewSlave(master *Master, conn net.Conn, decoder *json.Decoder) Slave {
-	return Slave{
-		id: uuid.New(),
-		master: master,
-		conn: conn,
-		decoder: decoder,
-		tasks: make(chan Task),
+func NewSlave(master *Master, conn net.Conn, decoder *json.Decoder, info helper.SlaveInfo) *Slave {
+	return &Slave{
+		id:           uuid.New(),
+		master:       master,
+		conn:         conn,
+		decoder:      decoder,
+		fileserver:   info.Fileserver,
+		machine:      info.Machine,
+		rack:         info.Rack,
+		labels:       info.Labels,
+		tasks:        make(chan Task),
 		transactions: make(map[string]chan helper.Transaction),
+		lost:         make(IdSet),
 	}
 }
 
-
 type Master struct {
-	addr string
-	slaves map[string]Slave
-	fsdata FsData
+	addr       string
+	slaves     map[string]*Slave
+	fsdata     FsData
+	repairing  IdSet
+	active     IdSet
+	retention  time.Duration
+	locks      *LockManager
+	balancer   *Balancer
+	commitLock sync.Mutex
+	lock       sync.Mutex
+}
+
+func (self *Master) addSlave(slave *Slave) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.slaves[slave.id] = slave
+	return len(self.slaves)
+}
+
+func (self *Master) removeSlave(slave *Slave) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.slaves, slave.id)
+	return len(self.slaves)
+}
+
+// getSlaves returns connected slaves by ids, which can be already gone.
+func (self *Master) getSlaves(ids []string) ([]*Slave, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	res := make([]*Slave, len(ids))
+	for i, id := range ids {
+		slave, ok := self.slaves[id]
+		if !ok {
+			return nil, errors.New("Slave " + id + " is disconnected.")
+		}
+		res[i] = slave
+	}
+	return res, nil
 }
 
 func (self *Master) Run() error {
@@ -263,33 +700,41 @@ func (self *Master) Run() error {
 	return nil
 }
 
-func (self *Master) HandleSlave(conn net.Conn, decoder *json.Decoder) error {
-	slave := NewSlave(self, conn, decoder)
-	self.slaves[slave.id] = slave
+func (self *Master) HandleSlave(conn net.Conn, decoder *json.Decoder, info helper.SlaveInfo) error {
+	slave := NewSlave(self, conn, decoder, info)
+	self.fsdata.SetRack(slave.id, slave.rack)
+	count := self.addSlave(slave)
 	defer func() {
-		delete(self.slaves, slave.id)
-		self.fsdata.Unlink(slave)
-		fmt.Println("close slave", len(self.slaves))
+		count := self.removeSlave(slave)
+		self.fsdata.Unlink(slave.id)
+		fmt.Println("close slave", count)
 	}()
-	fmt.Println("new slaves", len(self.slaves))
+	fmt.Println("new slaves", count)
 
 	upTr := helper.NewTransaction("fs_get")
-	if err := upTr.Send(conn); err != nil {
+	if err := slave.Send(upTr); err != nil {
 		return err
 	}
 
 	fmt.Println("asked for fs")
 
-	trans, err := slave.ReadMsg()
-	if err != nil {
-		return err
+	var trans helper.Transaction
+	for {
+		t, err := slave.ReadMsg()
+		if err != nil {
+			return err
+		}
+		if !slave.handleRequest(t) {
+			trans = t
+			break
+		}
 	}
 
 	fmt.Println("got fs", trans.Status)
 
 	if trans.Status == "finished" {
 		fmt.Println("updating...")
-		if err := self.fsdata.UpdateFromTrans(&slave, trans); err != nil {
+		if err := self.fsdata.UpdateFromTrans(slave, trans); err != nil {
 			return err
 		}
 	} else {
@@ -306,11 +751,11 @@ type Task struct {
 }
 
 type slaveTask struct {
-	slave Slave
+	slave *Slave
 	task Task
 }
 
-func (self *Master) RunTransactionSimple(slavesTasks []slaveTask) {
+func (self *Master) RunTransactionSimple(slavesTasks []slaveTask) []helper.Transaction {
 	fmt.Println("Run simple transaction")
 	for i := 0; i < len(slavesTasks); i++ {
 		fmt.Println("Sending task to a slave")
@@ -318,15 +763,121 @@ func (self *Master) RunTransactionSimple(slavesTasks []slaveTask) {
 		fmt.Println("Sent task to a slave")
 	}
 
+	res := make([]helper.Transaction, len(slavesTasks))
 	for i := 0; i < len(slavesTasks); i++ {
 		fmt.Println("Wait for a slave")
-		<-slavesTasks[i].task.signal
+		res[i] = <-slavesTasks[i].task.signal
 		fmt.Println("Slave finished!")
 	}
 	fmt.Println("Finished simple transaction")
+	return res
+}
+
+// RunTwoPhase applies metadata steps atomically on all the slaves:
+// every slave prepares its new state aside and only if all of them
+// succeeded the new state is committed, otherwise it is rolled back.
+// Commits run one at a time, so others never see them half-applied.
+func (self *Master) RunTwoPhase(slavesSteps map[string][]helper.Step) error {
+	self.commitLock.Lock()
+	defer self.commitLock.Unlock()
+
+	ids := make([]string, 0, len(slavesSteps))
+	for k, _ := range slavesSteps {
+		ids = append(ids, k)
+	}
+	slaves, err := self.getSlaves(ids)
+	if err != nil {
+		return err
+	}
+
+	prepare := make([]slaveTask, len(ids))
+	for i, k := range ids {
+		tr := helper.NewTransaction("fs_prepare")
+		tr.Params.Steps = slavesSteps[k]
+		prepare[i] = slaveTask{
+			slave: slaves[i],
+			task: Task{
+				trans:  tr,
+				signal: make(chan helper.Transaction),
+			},
+		}
+	}
+
+	action := "fs_commit"
+	for i, tr := range self.RunTransactionSimple(prepare) {
+		if tr.Status != "finished" {
+			action = "fs_rollback"
+			err = errors.New("Slave " + prepare[i].slave.id + " failed to prepare transaction.")
+		}
+	}
+
+	finish := make([]slaveTask, len(prepare))
+	for i, st := range prepare {
+		tr := helper.NewTransaction(action)
+		tr.Params.Prepared = st.task.trans.Id
+		finish[i] = slaveTask{
+			slave: st.slave,
+			task: Task{
+				trans:  tr,
+				signal: make(chan helper.Transaction),
+			},
+		}
+	}
+
+	for i, tr := range self.RunTransactionSimple(finish) {
+		if tr.Status != "finished" {
+			// nothing can be done here, the slave has to recover by itself
+			fmt.Println("Error RunTwoPhase:", action, "failed on slave", finish[i].slave.id)
+			if err == nil {
+				err = errors.New("Slave " + finish[i].slave.id + " failed to " + action[3:] + " transaction.")
+			}
+		}
+	}
+	return err
+}
+
+// RunSteps runs move/copy/drop operations as a single atomic transaction.
+func (self *Master) RunSteps(steps []*hipstmr.Params) error {
+	tables := []string{}
+	fsSteps := []helper.Step{}
+	for _, p := range steps {
+		if p.Type != "move" && p.Type != "copy" && p.Type != "drop" {
+			return errors.New("Unknown transaction step " + p.Type + ".")
+		}
+
+		tables = append(tables, p.InputTables...)
+		if p.Type != "drop" {
+			if len(p.OutputTables) == 0 {
+				return errors.New("No output table for " + p.Type + ".")
+			}
+			tables = append(tables, p.OutputTables[0])
+		}
+
+		fsSteps = append(fsSteps, helper.Step{
+			Action: "fs_" + p.Type,
+			Params: helper.Params{
+				Params: p,
+			},
+		})
+		fsSteps = append(fsSteps, expireSteps(p)...)
+	}
+
+	self.fsdata.numberSteps(fsSteps)
+	slavesSteps := make(map[string][]helper.Step)
+	for _, k := range self.fsdata.GetTablesOwners(tables) {
+		slavesSteps[k] = fsSteps
+	}
+	return self.RunTwoPhase(slavesSteps)
+}
+
+// failedStatus tells if the task is over without results, slaves refuse
+// tasks with "no_space" status before writing outputs.
+func failedStatus(status string) bool {
+	return status == "failed" || status == "no_space"
 }
 
-func (self *Master) RunTransaction(conn net.Conn, trans helper.Transaction, slavesTasks []slaveTask) {
+// RunTransaction runs the tasks and returns an error, if any of them failed.
+func (self *Master) RunTransaction(conn net.Conn, trans helper.Transaction, slavesTasks []slaveTask) error {
 	fmt.Println("Run transaction")
 	for i := 0; i < len(slavesTasks); i++ {
 		fmt.Println("Sending task to a slave")
@@ -334,9 +885,23 @@ func (self *Master) RunTransaction(conn net.Conn, trans helper.Transaction, slav
 		fmt.Println("Sent task to a slave")
 	}
 
+	var err error = nil
+	done := make([]bool, len(slavesTasks))
+	onDone := func(i int, tr helper.Transaction) {
+		if failedStatus(tr.Status) && err == nil {
+			str, _ := tr.Payload.(string)
+			err = errors.New("Task failed on slave " + slavesTasks[i].slave.id + ": " + str)
+		}
+	}
+
 	for i := 0; i < len(slavesTasks); i++ {
 		fmt.Println("Sending files...")
-		<-slavesTasks[i].task.signal
+		tr := <-slavesTasks[i].task.signal
+		if failedStatus(tr.Status) {
+			// there will be no more messages from the task
+			done[i] = true
+			onDone(i, tr)
+		}
 		fmt.Println("Files sent!")
 	}
 
@@ -345,17 +910,43 @@ func (self *Master) RunTransaction(conn net.Conn, trans helper.Transaction, slav
 		fmt.Println("Error:", err)
 	}
 
-	stderr := ""
 	for i := 0; i < len(slavesTasks); i++ {
-		fmt.Println("Wait for a slave")
-		tr := <-slavesTasks[i].task.signal
-		str, ok := tr.Payload.(string)
-		if ok {
-			stderr += str
+		if done[i] {
+			continue
 		}
+		fmt.Println("Wait for a slave")
+		onDone(i, <-slavesTasks[i].task.signal)
 		fmt.Println("Slave finished!")
 	}
 	fmt.Println("Finished transaction")
+	return err
+}
+
+// watchClient closes the returned channel once the client disconnects,
+// till the returned function is called. Clients send nothing after
+// the request, so reads of the connection return only then.
+func watchClient(conn net.Conn) (<-chan struct{}, func()) {
+	gone := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+					close(gone)
+				}
+				return
+			}
+		}
+	}()
+
+	stop := func() {
+		conn.SetReadDeadline(time.Now())
+		<-exited
+		conn.SetReadDeadline(time.Time{})
+	}
+	return gone, stop
 }
 
 func (self *Master) HandleClient(conn net.Conn, trans helper.Transaction) error {
@@ -367,36 +958,168 @@ func (self *Master) HandleClient(conn net.Conn, trans helper.Transaction) error
 	}
 
 	typ := trans.Params.Params.Type
-	if typ == "move" || typ == "copy" || typ == "drop" {
-		job := helper.NewTransaction("fs_" + typ)
-		job.Params = helper.Params{
-			Params: trans.Params.Params,
-		}
-
-		tables := trans.Params.Params.InputTables
-		if typ != "drop" {
-			ts := make([]string, len(tables) + 1)
-			copy(ts, tables)
-			ts[len(tables)] = trans.Params.Params.OutputTables[0]
-			tables = ts
-		}
-		slaves := self.fsdata.GetTablesOwners(tables)
-		slavesTasks := make([]slaveTask, len(slaves))
-		for sn := 0; sn < len(slavesTasks); sn++ {
-			slavesTasks[sn] = slaveTask{
-				slave: self.slaves[slaves[sn]],
-				task: Task{
-					trans:  job,
-					signal: make(chan helper.Transaction),
-				},
+	shared, exclusive := lockedTables(trans.Params.Params)
+	if len(shared)+len(exclusive) != 0 {
+		gone, stop := watchClient(conn)
+		err := self.locks.Lock(trans.Id, typ, shared, exclusive, !trans.Params.Params.NoWait, gone)
+		stop()
+		if err != nil {
+			return err
+		}
+		defer self.locks.Unlock(trans.Id)
+	}
+
+	if typ == "status" {
+		trans.Status = "finished"
+		trans.Params.Params = nil
+		trans.Payload = self.Status()
+		if err := trans.Send(conn); err != nil {
+			fmt.Println("Error:", err)
+		}
+	} else if typ == "move" || typ == "copy" || typ == "drop" || typ == "transaction" {
+		if err := checkWritable(writtenTables(trans.Params.Params)); err != nil {
+			return err
+		}
+		steps := []*hipstmr.Params{trans.Params.Params}
+		if typ == "transaction" {
+			steps = trans.Params.Params.Steps
+		}
+
+		if err := self.RunSteps(self.toTrash(steps)); err != nil {
+			return err
+		}
+		trans.Status = "finished"
+		if err := trans.Send(conn); err != nil {
+			fmt.Println("Error:", err)
+		}
+	} else if typ == "undrop" || typ == "empty_trash" {
+		var err error = nil
+		if typ == "undrop" {
+			if len(trans.Params.Params.InputTables) != 1 {
+				return errors.New("Undrop needs exactly one table.")
+			}
+			err = self.Undrop(trans.Params.Params.InputTables[0])
+		} else {
+			err = self.EmptyTrash(!trans.Params.Params.NoWait)
+		}
+		if err != nil {
+			return err
+		}
+		trans.Status = "finished"
+		if err := trans.Send(conn); err != nil {
+			fmt.Println("Error:", err)
+		}
+	} else if typ == "stat" || typ == "set_ttl" {
+		if len(trans.Params.Params.InputTables) != 1 {
+			return errors.New("Exactly one table is expected.")
+		}
+		tbl := trans.Params.Params.InputTables[0]
+		if typ == "set_ttl" {
+			if err := checkWritable([]string{tbl}); err != nil {
+				return err
 			}
 		}
-		self.RunTransactionSimple(slavesTasks)
+		if typ == "stat" {
+			stat, err := self.fsdata.Stat(tbl)
+			if err != nil {
+				return err
+			}
+			trans.Payload = stat
+		} else if err := self.SetTtl(tbl, trans.Params.Params.Ttl[tbl]); err != nil {
+			return err
+		}
 		trans.Status = "finished"
+		trans.Params.Params = nil
+		if err := trans.Send(conn); err != nil {
+			fmt.Println("Error:", err)
+		}
+	} else if typ == "snapshot" || typ == "snapshots" || typ == "drop_snapshot" {
+		tbl := ""
+		if len(trans.Params.Params.InputTables) != 0 {
+			tbl = trans.Params.Params.InputTables[0]
+		}
+		name := trans.Params.Params.Name
+
+		var err error = nil
+		if typ == "snapshot" {
+			err = self.Snapshot(tbl, name)
+		} else if typ == "drop_snapshot" {
+			err = self.DropSnapshot(tbl, name)
+		} else {
+			trans.Payload, err = self.Snapshots(tbl)
+		}
+		if err != nil {
+			return err
+		}
+		trans.Status = "finished"
+		trans.Params.Params = nil
+		if err := trans.Send(conn); err != nil {
+			fmt.Println("Error:", err)
+		}
+	} else if typ == "merge" {
+		if len(trans.Params.Params.InputTables) != 1 {
+			return errors.New("Merge needs exactly one table.")
+		}
+		if err := checkWritable(trans.Params.Params.InputTables); err != nil {
+			return err
+		}
+		if err := self.Merge(trans.Params.Params.InputTables[0], trans.Params.Params.ChunkSize); err != nil {
+			return err
+		}
+		trans.Status = "finished"
+		trans.Params.Params = nil
+		if err := trans.Send(conn); err != nil {
+			fmt.Println("Error:", err)
+		}
+	} else if typ == "balance" {
+		stats, err := self.balancer.Balance()
+		if err != nil {
+			return err
+		}
+		trans.Status = "finished"
+		trans.Params.Params = nil
+		trans.Payload = stats
+		if err := trans.Send(conn); err != nil {
+			fmt.Println("Error:", err)
+		}
+	} else if typ == "decommission" {
+		ids, err := self.Decommission(trans.Params.Params.Name)
+		if err != nil {
+			return err
+		}
+		trans.Status = "finished"
+		trans.Params.Params = nil
+		trans.Payload = ids
+		if err := trans.Send(conn); err != nil {
+			fmt.Println("Error:", err)
+		}
+	} else if typ == "locks" {
+		trans.Status = "finished"
+		trans.Params.Params = nil
+		trans.Payload = self.locks.List()
+		if err := trans.Send(conn); err != nil {
+			fmt.Println("Error:", err)
+		}
+	} else if typ == "fsck" {
+		report, err := self.Fsck(trans.Params.Params.Repair)
+		if err != nil {
+			return err
+		}
+		trans.Status = "finished"
+		trans.Params.Params = nil
+		trans.Payload = report
 		if err := trans.Send(conn); err != nil {
 			fmt.Println("Error:", err)
 		}
 	} else if typ == "map" {
+		if err := checkWritable(trans.Params.Params.OutputTables); err != nil {
+			return err
+		}
+
+		// fsck keeps temporary data of active transactions
+		self.setActive(trans.Id, true)
+		defer self.setActive(trans.Id, false)
+
 		job := helper.Transaction{
 			Id:     trans.Id,
 			Action: "mr_map",
@@ -406,14 +1129,37 @@ func (self *Master) HandleClient(conn net.Conn, trans helper.Transaction) error
 			},
 		}
 
-		tables := make([]string, len(trans.Params.Params.InputTables) + len(trans.Params.Params.OutputTables))
-		copy(tables, trans.Params.Params.InputTables)
-		copy(tables[len(trans.Params.Params.InputTables):], trans.Params.Params.OutputTables)
+		allowed := self.selectSlaves(trans.Params.Params.NodeSelector)
+		if allowed != nil && len(allowed) == 0 {
+			return errors.New("No slaves match the node selector.")
+		}
+
+		pins, err := self.pinTables(trans.Id, trans.Params.Params.InputTables)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := self.unpinTables(pins); err != nil {
+				fmt.Println("Error: failed to unpin tables:", err)
+			}
+		}()
 
-		slaves := self.fsdata.GetTablesOwnersChunks(tables)
-		slavesTasks := make([]slaveTask, len(slaves))
-		sn := 0
-		for k, v := range slaves {
+		slaves, err := self.fsdata.GetInputChunks(pins, allowed)
+		if err != nil {
+			return err
+		}
+		ids := make([]string, 0, len(slaves))
+		for k, _ := range slaves {
+			ids = append(ids, k)
+		}
+		owners, err := self.getSlaves(ids)
+		if err != nil {
+			return err
+		}
+
+		slavesTasks := make([]slaveTask, len(ids))
+		for sn, k := range ids {
+			v := slaves[k]
 			tr := job
 			tr.Params.Chunks = v
 			tr.Params.OutputTables = make([]string, len(tr.Params.Params.OutputTables))
@@ -422,57 +1168,79 @@ func (self *Master) HandleClient(conn net.Conn, trans helper.Transaction) error
 			}
 
 			slavesTasks[sn] = slaveTask{
-				slave: self.slaves[k],
+				slave: owners[sn],
 				task: Task{
 					trans:  tr,
 					signal: make(chan helper.Transaction),
 				},
 			}
-			sn++
 		}
 
-		self.RunTransaction(conn, trans, slavesTasks)
+		if err := self.RunTransaction(conn, trans, slavesTasks); err != nil {
+			tmpTbls := []string{}
+			for _, st := range slavesTasks {
+				tmpTbls = append(tmpTbls, st.task.trans.Params.OutputTables...)
+			}
+			drop := &hipstmr.Params{
+				Type:        "drop",
+				InputTables: tmpTbls,
+			}
+			if err := self.RunSteps([]*hipstmr.Params{drop}); err != nil {
+				fmt.Println("Error: failed to drop temporary tables:", err)
+			}
+			return err
+		}
 
 		// move
 		fmt.Println("~~~~", trans.Params.Params.OutputTables)
+		commitSteps := make(map[string][]helper.Step)
 		for i, tbl := range trans.Params.Params.OutputTables {
 			tmpTbls := make([]string, len(slaves))
 			for j, st := range slavesTasks {
 				tmpTbls[j] = st.task.trans.Params.OutputTables[i]
 			}
 
-			job := helper.NewTransaction("fs_move_chunks")
-			job.Params = helper.Params{
-				Params: &hipstmr.Params{
-					InputTables: tmpTbls,
+			job := helper.Step{
+				Action: "fs_move_chunks",
+				Params: helper.Params{
+					Params: &hipstmr.Params{
+						InputTables: tmpTbls,
+					},
 				},
 			}
 
 			var num uint64 = 0
 			moveSlaves := self.fsdata.GetTablesOwnersChunks(tmpTbls)
-			slavesTasks := make([]slaveTask, len(moveSlaves))
-			sp := 0
+			if trans.Params.Params.IsAppend(tbl) {
+				job.Params.Params.AppendTables = []string{tbl}
+				num = self.fsdata.NextChunkNum(tbl)
+			} else {
+				// old chunks of the output have to be deleted on every slave
+				for _, k := range self.fsdata.GetTablesOwners([]string{tbl}) {
+					if _, ok := moveSlaves[k]; !ok {
+						moveSlaves[k] = []string{}
+					}
+				}
+			}
 			for k, v := range moveSlaves {
-				tr := job
-				tr.Params.Chunks = v
-				tr.Params.OutputChunkNums = make([]uint64, len(v))
-				for kk := 0; kk < len(tr.Params.OutputChunkNums); kk++ {
-					tr.Params.OutputChunkNums[kk] = num
+				step := job
+				step.Params.Chunks = v
+				step.Params.OutputChunkNums = make([]uint64, len(v))
+				for kk := 0; kk < len(step.Params.OutputChunkNums); kk++ {
+					step.Params.OutputChunkNums[kk] = num
 					num++
 				}
-				tr.Params.OutputTables = []string{tbl}
-
-				slavesTasks[sp] = slaveTask{
-					slave: self.slaves[k],
-					task: Task{
-						trans:  tr,
-						signal: make(chan helper.Transaction),
-					},
-				}
-				sp++
+				step.Params.OutputTables = []string{tbl}
+				commitSteps[k] = append(commitSteps[k], step)
 			}
+		}
 
-			self.RunTransactionSimple(slavesTasks)
+		for k, _ := range commitSteps {
+			commitSteps[k] = append(commitSteps[k], expireSteps(trans.Params.Params)...)
+		}
+
+		if err := self.RunTwoPhase(commitSteps); err != nil {
+			return err
 		}
 
 		trans.Status = "finished"
@@ -514,7 +1282,17 @@ func (self *Master) DoHandle(conn net.Conn) error {
 			},
 		})
 	} else {
-		return self.HandleSlave(conn, decoder)
+		// slaves tell the address of their fileserver and their machine
+		// on connect, older ones send only the address
+		var info helper.SlaveInfo
+		if len(clTrans.Payload) != 0 {
+			if err := json.Unmarshal(clTrans.Payload, &info.Fileserver); err != nil {
+				if err := json.Unmarshal(clTrans.Payload, &info); err != nil {
+					info = helper.SlaveInfo{}
+				}
+			}
+		}
+		return self.HandleSlave(conn, decoder, info)
 	}
 }
 
@@ -525,12 +1303,31 @@ func (self *Master) Handle(conn net.Conn) {
 	}
 }
 
+// UpdateFsFromTask applies the delta, which slaves attach to finished
+// metadata operations, and falls back to asking for it explicitly.
+func (self *Master) UpdateFsFromTask(slave *Slave, trans helper.Transaction) error {
+	if strings.HasPrefix(trans.Action, "fs_") {
+		err := self.fsdata.UpdateFromTrans(slave, trans)
+		if err == nil {
+			return nil
+		}
+		fmt.Println("Error UpdateFsFromTask:", err)
+	}
+	return self.UpdateFs(slave)
+}
+
 func (self *Master) UpdateFs(slave *Slave) error {
 	signal := make(chan error)
-	err := slave.sendNewOnceTransaction(helper.NewTransaction("fs_get"), func(trans helper.Transaction) {
+	upTr := helper.NewTransaction("fs_get")
+	upTr.Params.Since = self.fsdata.GetSeq(slave.id)
+	err := slave.sendNewOnceTransaction(upTr, func(trans helper.Transaction) {
 		var err error = nil
 		if trans.Status == "finished" {
 			err = self.fsdata.UpdateFromTrans(slave, trans)
+			if err != nil {
+				// the next update will ask for the whole metadata
+				self.fsdata.Unlink(slave.id)
+			}
 		} else {
 			err = errors.New("Transaction status is " + trans.Status)
 			fmt.Println("Error askForFS:", trans)
@@ -543,11 +1340,15 @@ func (self *Master) UpdateFs(slave *Slave) error {
 	return <-signal
 }
 
-func NewMaster(addr string) Master {
+func NewMaster(addr string, retention time.Duration) Master {
 	return Master{
 		addr: addr,
-		slaves: make(map[string]Slave),
+		retention: retention,
+		locks: NewLockManager(0),
+		slaves: make(map[string]*Slave),
 		fsdata: NewFsData(),
+		repairing: make(IdSet),
+		active: make(IdSet),
 	}
 }
 
@@ -555,13 +1356,27 @@ func NewMaster(addr string) Master {
 func main() {
 	help := flag.Bool("help", false, "print this help")
 	address := flag.String("address", "", "master adress")
+	retention := flag.Duration("trash-retention", 72*time.Hour, "time to keep dropped tables for, 0 drops them at once")
+	balanceInterval := flag.Duration("balance-interval", time.Hour, "interval between balancing chunks across slaves, 0 disables it")
+	balanceThreshold := flag.Float64("balance-threshold", 0.1, "allowed deviation of slave's usage from the average, as a fraction of it")
+	balanceRate := flag.Int64("balance-rate", 32<<20, "bytes per second to move chunks at, 0 means no limit")
+	lockTimeout := flag.Duration("lock-timeout", time.Hour, "time to wait for locked tables, 0 means no limit")
 	flag.Parse()
 	if *help || *address == "" {
 		flag.PrintDefaults()
 		return
 	}
 
-	master := NewMaster(*address)
+	master := NewMaster(*address, *retention)
+	master.locks = NewLockManager(*lockTimeout)
+	master.balancer = NewBalancer(&master, *balanceThreshold, *balanceRate, *balanceInterval)
+	if *balanceInterval > 0 {
+		go master.balancer.Run()
+	}
+	if *retention > 0 {
+		go master.PurgeTrash()
+	}
+	go master.ExpireTables()
 	if err := master.Run(); err != nil {
 		fmt.Println("Error:", err)
 		return
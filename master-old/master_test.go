@@ -0,0 +1,226 @@
+package main
+
+import (
+	"HipstMR/helper"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fullDelta returns the whole metadata of a slave with the chunks
+// of the table.
+func fullDelta(tbl string, chunks []string) helper.Delta {
+	data := helper.FsData{}
+	for i, chunk := range chunks {
+		data.AddChunk(chunk, "", 1, 0)
+		data.AddTag(chunk, tbl, uint64(i))
+	}
+	data.Seq = 1
+	return data.Delta(0)
+}
+
+// Run with -race: updates from slaves race with readers of the index.
+func TestFsDataConcurrentAccess(t *testing.T) {
+	fsdata := NewFsData()
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+
+	for s := 0; s < 4; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			id := fmt.Sprintf("slave%d", s)
+			fsdata.SetRack(id, fmt.Sprintf("rack%d", s%2))
+			fsdata.SetAvailable(id, 1<<30)
+			if err := fsdata.Update(id, fullDelta("t", []string{id + "-0"})); err != nil {
+				t.Error(err)
+				return
+			}
+			for i := 1; i < 50; i++ {
+				chunk := fmt.Sprintf("%s-%d", id, i)
+				delta := helper.Delta{
+					From: uint64(i),
+					To:   uint64(i + 1),
+					Mutations: []helper.Mutation{
+						{Op: "add_chunk", Chunk: chunk, Size: 1},
+						{Op: "add_tag", Chunk: chunk, Tag: "t", Num: uint64(i)},
+					},
+				}
+				if err := fsdata.Update(id, delta); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			fsdata.Unlink(id)
+		}(s)
+	}
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				fsdata.GetTablesOwners([]string{"t"})
+				fsdata.GetTablesOwnersChunks([]string{"t"})
+				fsdata.NextChunkNum("t")
+				fsdata.GetSeq("slave0")
+				fsdata.CheckTables()
+				if _, err := fsdata.GetInputChunks([]string{"t"}, nil); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	if owners := fsdata.GetTablesOwners([]string{"t"}); len(owners) != 0 {
+		t.Fatal("unlinked slaves still own the table:", owners)
+	}
+}
+
+// Run with -race: slaves connect and disconnect while others look them up.
+func TestMasterSlavesConcurrentAccess(t *testing.T) {
+	master := NewMaster("", 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				slave := NewSlave(&master, nil, nil, helper.SlaveInfo{})
+				master.addSlave(slave)
+				if _, err := master.getSlaves([]string{slave.id}); err != nil {
+					t.Error(err)
+				}
+				master.removeSlave(slave)
+				if _, err := master.getSlaves([]string{slave.id}); err == nil {
+					t.Error("removed slave", slave.id, "is found")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func newPipeSlave(t *testing.T) *Slave {
+	client, server := net.Pipe()
+	go io.Copy(ioutil.Discard, server)
+	master := NewMaster("", 0)
+	return NewSlave(&master, client, nil, helper.SlaveInfo{})
+}
+
+// Run with -race: replies and the disconnect of the slave race with new
+// transactions. Every sent transaction has to end exactly once.
+func TestSlaveTransactionsEndOnDisconnect(t *testing.T) {
+	slave := newPipeSlave(t)
+
+	var lock sync.Mutex
+	ended := make(map[string]int)
+	sent := make(chan string, 1000)
+	var wg sync.WaitGroup
+
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				trans := helper.NewTransaction("fs_get")
+				callback := func(tr helper.Transaction) {
+					if tr.Status != "finished" && tr.Status != "failed" {
+						return
+					}
+					slave.closeTransaction(tr.Id)
+					lock.Lock()
+					ended[tr.Id]++
+					lock.Unlock()
+				}
+
+				var err error
+				if i%2 == 0 {
+					err = slave.sendNewTransaction(trans, callback)
+				} else {
+					err = slave.sendNewOnceTransaction(trans, callback)
+				}
+				if err == nil {
+					sent <- trans.Id
+				}
+			}
+		}(g)
+	}
+
+	// replies are delivered the way Run does, then the slave disconnects
+	ids := make(map[string]bool)
+	for len(ids) < 40 {
+		id := <-sent
+		if ch, ok := slave.getTransaction(id); ok {
+			ch <- helper.Transaction{Id: id, Status: "finished"}
+		}
+		ids[id] = true
+	}
+	slave.failTransactions()
+	wg.Wait()
+	close(sent)
+	for id := range sent {
+		ids[id] = true
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lock.Lock()
+		done := len(ended) == len(ids)
+		lock.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for id, _ := range ids {
+		if ended[id] != 1 {
+			t.Errorf("transaction %s ended %d times", id, ended[id])
+		}
+	}
+
+	if err := slave.sendNewTransaction(helper.NewTransaction("fs_get"), func(helper.Transaction) {}); err == nil {
+		t.Error("transaction is sent to the disconnected slave")
+	}
+}
+
+func TestWatchClient(t *testing.T) {
+	client, server := net.Pipe()
+	gone, stop := watchClient(server)
+	client.Close()
+	select {
+	case <-gone:
+	case <-time.After(time.Second):
+		t.Fatal("disconnect of the client is not noticed")
+	}
+	stop()
+
+	client, server = net.Pipe()
+	gone, stop = watchClient(server)
+	stop()
+	select {
+	case <-gone:
+		t.Fatal("stopped watch reports the client gone")
+	default:
+	}
+	go client.Read(make([]byte, 1))
+	if _, err := server.Write([]byte{0}); err != nil {
+		t.Fatal("connection is unusable after the watch:", err)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"HipstMR/helper"
+	"HipstMR/lib/go/hipstmr"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+)
+
+// mergeRun is a sequence of chunks of a table, which follow one another
+// and are read from the same slave.
+type mergeRun struct {
+	slave  string
+	chunks []string
+}
+
+// tableRuns splits chunks of the table in the order of their numbers into
+// runs. Replicated chunks are read from the slave of the previous chunk
+// if possible, bad ones from healthy replicas and draining slaves are
+// avoided.
+func (self *FsData) tableRuns(tbl string) ([]mergeRun, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	tagData, ok := self.index[tbl]
+	if !ok {
+		return nil, errors.New("Table " + tbl + " doesn't exist.")
+	}
+
+	type entry struct {
+		num    uint64
+		chunk  string
+		slaves []string
+	}
+	entries := make(map[string]*entry)
+	for slave, chunks := range tagData {
+		for chunk, _ := range chunks {
+			for _, n := range self.slaves[slave].Chunks[chunk].Tags[tbl] {
+				key := fmt.Sprintf("%s/%d", chunk, n)
+				e, ok := entries[key]
+				if !ok {
+					e = &entry{
+						num:   n,
+						chunk: chunk,
+					}
+					entries[key] = e
+				}
+				if !self.bad[slave][chunk] {
+					e.slaves = append(e.slaves, slave)
+				}
+			}
+		}
+	}
+
+	sorted := make([]*entry, 0, len(entries))
+	for _, e := range entries {
+		if len(e.slaves) == 0 {
+			return nil, errors.New("Chunk " + e.chunk + " of table " + tbl + " has no healthy replicas.")
+		}
+		sort.Strings(e.slaves)
+		e.slaves = self.preferLive(e.slaves)
+		sorted = append(sorted, e)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].num != sorted[j].num {
+			return sorted[i].num < sorted[j].num
+		}
+		return sorted[i].chunk < sorted[j].chunk
+	})
+
+	res := []mergeRun{}
+	for _, e := range sorted {
+		slave := e.slaves[0]
+		if len(res) != 0 {
+			for _, s := range e.slaves {
+				if s == res[len(res)-1].slave {
+					slave = s
+				}
+			}
+		}
+		if len(res) == 0 || res[len(res)-1].slave != slave {
+			res = append(res, mergeRun{
+				slave: slave,
+			})
+		}
+		res[len(res)-1].chunks = append(res[len(res)-1].chunks, e.chunk)
+	}
+	return res, nil
+}
+
+func (self *FsData) GetExpires(tbl string) int64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.getExpires(tbl)
+}
+
+// tableReplicas returns the least number of healthy replicas of a chunk
+// of the table.
+func (self *FsData) tableReplicas(tbl string) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	counts := make(map[string]int)
+	for slave, chunks := range self.index[tbl] {
+		for chunk, _ := range chunks {
+			if !self.bad[slave][chunk] {
+				counts[chunk]++
+			}
+		}
+	}
+	res := 0
+	for _, n := range counts {
+		if res == 0 || n < res {
+			res = n
+		}
+	}
+	return res
+}
+
+// mergePlan places chunks of the merged table: chunks with their numbers
+// by slaves, which tag them, and copies of the merged chunks.
+type mergePlan struct {
+	chunks map[string][]string
+	nums   map[string][]uint64
+	copies []chunkMove
+}
+
+func (self *mergePlan) add(slave, chunk string, num uint64) {
+	self.chunks[slave] = append(self.chunks[slave], chunk)
+	self.nums[slave] = append(self.nums[slave], num)
+}
+
+// planMerged numbers chunks of the temporary tables in the order of runs.
+// Chunks left as they are keep their healthy replicas. Merged ones are
+// copied from the slave of their run to the least used targets, in other
+// racks if possible, until they have as many replicas as the table had.
+func (self *FsData) planMerged(tbl string, runs []mergeRun, tmpTbls []string, replicas int, targets []string) (mergePlan, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := mergePlan{
+		chunks: make(map[string][]string),
+		nums:   make(map[string][]uint64),
+	}
+	usage := make(map[string]uint64)
+	for _, target := range targets {
+		usage[target] = self.used(target)
+	}
+
+	var num uint64 = 0
+	for i, run := range runs {
+		fsData, ok := self.slaves[run.slave]
+		if !ok {
+			return res, errors.New("Slave " + run.slave + " is disconnected.")
+		}
+		for _, chunk := range fsData.TagChunks(tmpTbls[i]) {
+			res.add(run.slave, chunk, num)
+			ch := fsData.Chunks[chunk]
+
+			if _, ok := ch.Tags[tbl]; ok {
+				for slave, other := range self.slaves {
+					if slave == run.slave || self.bad[slave][chunk] {
+						continue
+					}
+					if replica, ok := other.Chunks[chunk]; ok {
+						if _, ok := replica.Tags[tbl]; ok {
+							res.add(slave, chunk, num)
+						}
+					}
+				}
+				num++
+				continue
+			}
+
+			chosen := IdSet{run.slave: true}
+			racks := map[string]bool{self.racks[run.slave]: true}
+			for len(chosen) < replicas {
+				to := ""
+				for _, spread := range []bool{true, false} {
+					for _, target := range targets {
+						if chosen[target] || self.draining[target] || !self.hasSpace(target, ch.Size) {
+							continue
+						}
+						if spread && self.racks[target] != "" && racks[self.racks[target]] {
+							continue
+						}
+						if to == "" || usage[target] < usage[to] {
+							to = target
+						}
+					}
+					if to != "" {
+						break
+					}
+				}
+				if to == "" {
+					return res, errors.New(fmt.Sprintf("No slaves for %d replicas of merged chunks of table %s.", replicas, tbl))
+				}
+
+				chosen[to] = true
+				racks[self.racks[to]] = true
+				usage[to] += ch.Size
+				res.copies = append(res.copies, chunkMove{
+					from:  run.slave,
+					to:    to,
+					chunk: chunk,
+					data: helper.ChunkData{
+						Size:     ch.Size,
+						Checksum: ch.Checksum,
+						Tags:     helper.TagsSet{tbl: []uint64{num}},
+					},
+				})
+			}
+			num++
+		}
+	}
+	return res, nil
+}
+
+// copyMerged copies files of the merged chunks by fileservers.
+func (self *Master) copyMerged(copies []chunkMove) error {
+	for _, move := range copies {
+		slaves, err := self.getSlaves([]string{move.from, move.to})
+		if err != nil {
+			return err
+		}
+		if err := copyChunk(slaves[0].fileserver, slaves[1].fileserver, move.chunk, move.data.Checksum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merge rewrites every run of the table on its slave and then replaces
+// chunks of the table with the merged ones numbered in the same order.
+// Merged chunks are copied to keep the replication of the table, chunks
+// left as they are are renumbered on all their replicas. Replicas of
+// the old chunks are removed with them.
+func (self *Master) Merge(tbl string, chunkSize int64) error {
+	runs, err := self.fsdata.tableRuns(tbl)
+	if err != nil {
+		return err
+	}
+	replicas := self.fsdata.tableReplicas(tbl)
+
+	ids := make([]string, len(runs))
+	for i, run := range runs {
+		ids[i] = run.slave
+	}
+	slaves, err := self.getSlaves(ids)
+	if err != nil {
+		return err
+	}
+
+	tasks := make([]slaveTask, len(runs))
+	tmpTbls := make([]string, len(runs))
+	for i, run := range runs {
+		tr := helper.NewTransaction("mr_merge")
+		tmpTbls[i] = path.Join("tmp", tr.Id, "merge")
+		tr.Params.Chunks = run.chunks
+		tr.Params.OutputTables = []string{tmpTbls[i]}
+		tr.Params.Params = &hipstmr.Params{
+			ChunkSize: chunkSize,
+		}
+		tasks[i] = slaveTask{
+			slave: slaves[i],
+			task: Task{
+				trans:  tr,
+				signal: make(chan helper.Transaction),
+			},
+		}
+
+		// garbage collection keeps temporary tables of active transactions
+		self.setActive(tr.Id, true)
+		defer self.setActive(tr.Id, false)
+	}
+
+	for i, tr := range self.RunTransactionSimple(tasks) {
+		if tr.Status != "finished" {
+			err = errors.New("Merge failed on slave " + runs[i].slave + ".")
+		}
+	}
+	var plan mergePlan
+	if err == nil {
+		plan, err = self.fsdata.planMerged(tbl, runs, tmpTbls, replicas, self.liveSlaves())
+	}
+	if err == nil {
+		err = self.copyMerged(plan.copies)
+	}
+	if err != nil {
+		// copied files are left to garbage collection
+		drop := &hipstmr.Params{
+			Type:        "drop",
+			InputTables: tmpTbls,
+		}
+		if err := self.RunSteps([]*hipstmr.Params{drop}); err != nil {
+			fmt.Println("Error: failed to drop temporary tables:", err)
+		}
+		return err
+	}
+
+	step := helper.Step{
+		Action: "fs_move_chunks",
+		Params: helper.Params{
+			Params: &hipstmr.Params{
+				InputTables: tmpTbls,
+			},
+			OutputTables: []string{tbl},
+		},
+	}
+	commitSteps := make(map[string][]helper.Step)
+	// old chunks have to be deleted on every slave
+	for _, k := range self.fsdata.GetTablesOwners([]string{tbl}) {
+		commitSteps[k] = []helper.Step{step}
+	}
+	for slave, chunks := range plan.chunks {
+		st := step
+		st.Params.Chunks = chunks
+		st.Params.OutputChunkNums = plan.nums[slave]
+		commitSteps[slave] = []helper.Step{st}
+	}
+	for _, move := range plan.copies {
+		commitSteps[move.to] = append(commitSteps[move.to], self.addChunkSteps(move)...)
+	}
+
+	// dropping old chunks forgets the expiration time
+	if expires := self.fsdata.GetExpires(tbl); expires != 0 {
+		for k, _ := range commitSteps {
+			commitSteps[k] = append(commitSteps[k], helper.Step{
+				Action: "fs_set_expire",
+				Params: helper.Params{
+					Params: &hipstmr.Params{
+						InputTables: []string{tbl},
+					},
+					Expires: expires,
+				},
+			})
+		}
+	}
+	return self.RunTwoPhase(commitSteps)
+}
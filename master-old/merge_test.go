@@ -0,0 +1,55 @@
+package main
+
+import (
+	"HipstMR/helper"
+	"testing"
+)
+
+func TestPlanMergedKeepsReplication(t *testing.T) {
+	tmp := "tmp/tr/merge"
+	// m1 has merged small chunks a and b into m, big is left as it is
+	master, ids := newRackMaster(t, map[string]map[string]helper.ChunkData{
+		"m1": {
+			"a":   tagged("t", 1),
+			"m":   tagged(tmp, 2),
+			"big": {Size: 10, Tags: helper.TagsSet{"t": {2}, tmp: {1}}},
+		},
+		"m2": {"heavy": tagged("u", 100)},
+		"m3": {
+			"a":   tagged("t", 1),
+			"big": {Size: 10, Tags: helper.TagsSet{"t": {2}}},
+		},
+	})
+	fsdata := &master.fsdata
+	replicas := fsdata.tableReplicas("t")
+	if replicas != 2 {
+		t.Fatal("table t has", replicas, "replicas")
+	}
+
+	runs := []mergeRun{{slave: ids["m1"], chunks: []string{"a", "big"}}}
+	targets := []string{ids["m2"], ids["m3"], ids["m4"]}
+	plan, err := fsdata.planMerged("t", runs, []string{tmp}, replicas, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m1 := plan.chunks[ids["m1"]]
+	if len(m1) != 2 || m1[0] != "m" || m1[1] != "big" || plan.nums[ids["m1"]][0] != 0 || plan.nums[ids["m1"]][1] != 1 {
+		t.Errorf("m1 tags %v with %v", m1, plan.nums[ids["m1"]])
+	}
+	// the replica of the kept chunk is renumbered, not deleted
+	m3 := plan.chunks[ids["m3"]]
+	if len(m3) != 1 || m3[0] != "big" || plan.nums[ids["m3"]][0] != 1 {
+		t.Errorf("m3 tags %v with %v", m3, plan.nums[ids["m3"]])
+	}
+	// the merged chunk goes to the least used slave of the other rack
+	if len(plan.copies) != 1 || plan.copies[0].chunk != "m" || plan.copies[0].from != ids["m1"] || plan.copies[0].to != ids["m4"] {
+		t.Errorf("copies: %+v", plan.copies)
+	} else if nums := plan.copies[0].data.Tags["t"]; len(nums) != 1 || nums[0] != 0 {
+		t.Errorf("copy of m is tagged %v", plan.copies[0].data.Tags)
+	}
+
+	if _, err := fsdata.planMerged("t", runs, []string{tmp}, 5, targets); err == nil {
+		t.Error("5 replicas are planned on 4 slaves")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"HipstMR/lib/go/hipstmr"
+	"strings"
+)
+
+const pinPrefix = ".pin/"
+
+// pinTable names the version of the table read by the transaction.
+func pinTable(id, tbl string) string {
+	return pinPrefix + id + "/" + tbl
+}
+
+// pinTables makes versions of the tables for the transaction. Pins share
+// chunks with tables, so chunks stay while the transaction reads them,
+// even if the tables are overwritten or dropped. Two-phase commits don't
+// overlap, so pins see no half-applied changes and need no locks.
+func (self *Master) pinTables(id string, tables []string) ([]string, error) {
+	pins := make([]string, len(tables))
+	steps := make([]*hipstmr.Params, len(tables))
+	for i, tbl := range tables {
+		pins[i] = pinTable(id, tbl)
+		steps[i] = &hipstmr.Params{
+			Type:         "copy",
+			InputTables:  []string{tbl},
+			OutputTables: []string{pins[i]},
+		}
+	}
+	if err := self.RunSteps(steps); err != nil {
+		return nil, err
+	}
+	return pins, nil
+}
+
+// unpinTables drops the versions, chunks not used by tables anymore
+// are removed then.
+func (self *Master) unpinTables(pins []string) error {
+	if len(pins) == 0 {
+		return nil
+	}
+	return self.RunSteps([]*hipstmr.Params{{
+		Type:        "drop",
+		InputTables: pins,
+	}})
+}
+
+// pinnedTable returns the table of the pin.
+func pinnedTable(pin string) (string, bool) {
+	if !strings.HasPrefix(pin, pinPrefix) {
+		return "", false
+	}
+	parts := strings.SplitN(pin[len(pinPrefix):], "/", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	return parts[1], true
+}
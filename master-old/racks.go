@@ -0,0 +1,56 @@
+package main
+
+// SetRack remembers the rack of the slave machine, an empty rack
+// is unknown and never shared.
+func (self *FsData) SetRack(id, rack string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.racks[id] = rack
+}
+
+// rackTaken tells if a slave in the rack of the target, other than
+// the one the chunk leaves, already has the chunk.
+func (self *FsData) rackTaken(chunk, to, from string) bool {
+	rack := self.racks[to]
+	if rack == "" {
+		return false
+	}
+	for slave, fsData := range self.slaves {
+		if slave == from || slave == to || self.racks[slave] != rack {
+			continue
+		}
+		if _, ok := fsData.Chunks[chunk]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchLabels tells if the labels have all the values of the selector.
+func matchLabels(labels, selector map[string]string) bool {
+	for label, value := range selector {
+		if v, ok := labels[label]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// selectSlaves returns ids of the slaves matching the node selector,
+// nil means any slave.
+func (self *Master) selectSlaves(selector map[string]string) IdSet {
+	if len(selector) == 0 {
+		return nil
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := make(IdSet)
+	for id, slave := range self.slaves {
+		if matchLabels(slave.labels, selector) {
+			res[id] = true
+		}
+	}
+	return res
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"HipstMR/helper"
+	"HipstMR/utils"
+	"strings"
+	"testing"
+)
+
+// tagged is a chunk of the size with the first number in the table.
+func tagged(tbl string, size uint64) helper.ChunkData {
+	return helper.ChunkData{
+		Size: size,
+		Tags: helper.TagsSet{tbl: []uint64{0}},
+	}
+}
+
+// newRackMaster connects a slave for every machine of the example rack
+// config, where all the machines are on localhost, the way slaves started
+// with -config and -name describe themselves. Slaves of the machines have
+// the chunks. Slave ids are returned by machine names.
+func newRackMaster(t *testing.T, chunks map[string]map[string]helper.ChunkData) (*Master, map[string]string) {
+	cfg, err := utils.NewConfig("../cluster/racks.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	master := NewMaster("", 0)
+	ids := make(map[string]string)
+	for _, machine := range cfg.Data {
+		// every machine is found by its name, not by the shared address
+		nodeCfg := cfg.GetMachineCfg(machine.Name)
+		if nodeCfg == nil || nodeCfg.Name != machine.Name || nodeCfg.Addr != "localhost" {
+			t.Fatalf("machine %s is resolved to %+v", machine.Name, nodeCfg)
+		}
+
+		slave := NewSlave(&master, nil, nil, helper.SlaveInfo{
+			Machine: machine.Name,
+			Rack:    nodeCfg.Rack,
+			Labels:  nodeCfg.Labels,
+		})
+		master.fsdata.SetRack(slave.id, slave.rack)
+		master.addSlave(slave)
+		ids[machine.Name] = slave.id
+
+		data := helper.FsData{}
+		for id, ch := range chunks[machine.Name] {
+			data.AddChunk(id, "", ch.Size, 0)
+			for tag, nums := range ch.Tags {
+				for _, n := range nums {
+					data.AddTag(id, tag, n)
+				}
+			}
+		}
+		data.Seq = 1
+		if err := master.fsdata.Update(slave.id, data.Delta(0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ids) != 4 {
+		t.Fatal("expected 4 machines in the config, got", len(ids))
+	}
+	return &master, ids
+}
+
+func TestRackTaken(t *testing.T) {
+	master, ids := newRackMaster(t, map[string]map[string]helper.ChunkData{
+		"m1": {"c": tagged("t", 1)},
+	})
+	fsdata := &master.fsdata
+
+	tests := []struct {
+		to, from string
+		taken    bool
+	}{
+		// m1 shares the rack with m2
+		{"m2", "m3", true},
+		{"m2", "m4", true},
+		// the replica on m1 is the one moved away
+		{"m2", "m1", false},
+		{"m3", "m1", false},
+		{"m4", "m2", false},
+	}
+	for _, test := range tests {
+		if res := fsdata.rackTaken("c", ids[test.to], ids[test.from]); res != test.taken {
+			t.Errorf("rack of %s taken for chunk from %s: got %v, want %v", test.to, test.from, res, test.taken)
+		}
+	}
+}
+
+func TestPickChunkAvoidsTakenRack(t *testing.T) {
+	master, ids := newRackMaster(t, map[string]map[string]helper.ChunkData{
+		"m1": {"a": tagged("t", 1)},
+		"m3": {"a": tagged("t", 1), "b": tagged("t", 1), "big": tagged("t", 10)},
+	})
+	fsdata := &master.fsdata
+
+	// a is the first of chunks of the same size, but r1 has it already
+	if chunk, size := fsdata.pickChunk(ids["m3"], ids["m2"], 5, nil); chunk != "b" || size != 1 {
+		t.Errorf("chunk %q of %d bytes is picked for m2, want b", chunk, size)
+	}
+	if chunk, _ := fsdata.pickChunk(ids["m3"], ids["m2"], 5, IdSet{"b": true}); chunk != "" {
+		t.Errorf("chunk %q is picked for m2, which rack has the others", chunk)
+	}
+	// the largest chunk fitting the limit goes within the rack
+	if chunk, _ := fsdata.pickChunk(ids["m3"], ids["m4"], 10, nil); chunk != "big" {
+		t.Errorf("chunk %q is picked for m4, want big", chunk)
+	}
+}
+
+func TestPlanCopiesSpreadsOverRacks(t *testing.T) {
+	master, ids := newRackMaster(t, map[string]map[string]helper.ChunkData{
+		"m1": {"c": tagged("t", 1), "d": tagged("t", 1)},
+		"m2": {"heavy": tagged("u", 100)},
+		"m3": {"c": tagged("t", 1)},
+	})
+	fsdata := &master.fsdata
+	fsdata.SetDraining(ids["m1"])
+	fsdata.SetDraining(ids["m3"])
+
+	targets := []string{ids["m2"], ids["m4"]}
+	moves, later, lost := fsdata.planCopies(ids["m1"], targets)
+	if later != 0 || lost != 0 || len(moves) != 2 {
+		t.Fatalf("planned %d copies, %d later, %d lost", len(moves), later, lost)
+	}
+	for _, move := range moves {
+		want := ids["m4"]
+		if move.chunk == "c" {
+			// r2 keeps the draining replica, so the more used m2 is chosen
+			want = ids["m2"]
+		}
+		if move.to != want {
+			t.Errorf("chunk %s is copied to %s, want %s", move.chunk, move.to, want)
+		}
+	}
+
+	// without other racks the copy is made anyway
+	moves, _, _ = fsdata.planCopies(ids["m1"], []string{ids["m4"]})
+	if len(moves) != 2 || moves[0].to != ids["m4"] || moves[1].to != ids["m4"] {
+		t.Errorf("copies to the only target: %+v", moves)
+	}
+}
+
+func TestSelectSlavesAndInputChunks(t *testing.T) {
+	master, ids := newRackMaster(t, map[string]map[string]helper.ChunkData{
+		"m2": {"x": tagged("t1", 1), "y": tagged("t2", 1)},
+		"m3": {"x": tagged("t1", 1)},
+	})
+
+	if res := master.selectSlaves(nil); res != nil {
+		t.Error("empty selector matches", res)
+	}
+	ssd := master.selectSlaves(map[string]string{"ssd": "true"})
+	if len(ssd) != 2 || !ssd[ids["m1"]] || !ssd[ids["m3"]] {
+		t.Error("ssd selector matches", ssd)
+	}
+	if res := master.selectSlaves(map[string]string{"ssd": "false"}); len(res) != 0 {
+		t.Error("ssd=false selector matches", res)
+	}
+
+	// x is read from its replica on the ssd machine
+	chunks, err := master.fsdata.GetInputChunks([]string{"t1"}, ssd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || len(chunks[ids["m3"]]) != 1 || chunks[ids["m3"]][0] != "x" {
+		t.Error("t1 is read from", chunks)
+	}
+	chunks, err = master.fsdata.GetInputChunks([]string{"t1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks[ids["m2"]])+len(chunks[ids["m3"]]) != 1 {
+		t.Error("t1 is read from", chunks)
+	}
+
+	// y has no replica on ssd machines
+	if _, err := master.fsdata.GetInputChunks([]string{"t2"}, ssd); err == nil || !strings.Contains(err.Error(), "node selector") {
+		t.Error("t2 is read from ssd machines:", err)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"HipstMR/fileserver"
+	"HipstMR/helper"
+	"HipstMR/lib/go/hipstmr"
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// MarkBad remembers chunks found corrupted or missing on the slave,
+// they are not read from it until repaired. Previously known bad chunks
+// are forgotten if replace is set.
+func (self *FsData) MarkBad(id string, chunks []string, replace bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	set, ok := self.bad[id]
+	if !ok || replace {
+		set = make(IdSet)
+	}
+	for _, chunk := range chunks {
+		set[chunk] = true
+	}
+
+	if len(set) == 0 {
+		delete(self.bad, id)
+	} else {
+		self.bad[id] = set
+	}
+}
+
+func (self *FsData) ClearBad(id, chunk string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	delete(self.bad[id], chunk)
+	if len(self.bad[id]) == 0 {
+		delete(self.bad, id)
+	}
+}
+
+func (self *FsData) GetBad(id string) []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := []string{}
+	for chunk, _ := range self.bad[id] {
+		res = append(res, chunk)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (self *FsData) ChunksCount(id string) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	fsData, ok := self.slaves[id]
+	if !ok {
+		return 0
+	}
+	return len(fsData.Chunks)
+}
+
+// FindReplica returns another slave with a healthy copy of the chunk
+// and the checksum of the chunk.
+func (self *FsData) FindReplica(id, chunk string) (string, uint32, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.findReplica(id, chunk)
+}
+
+func (self *FsData) findReplica(id, chunk string) (string, uint32, bool) {
+	for slave, fsData := range self.slaves {
+		if slave == id || self.bad[slave][chunk] {
+			continue
+		}
+		if data, ok := fsData.Chunks[chunk]; ok {
+			return slave, data.Checksum, true
+		}
+	}
+	return "", 0, false
+}
+
+func (self *Slave) setScrub(status hipstmr.ScrubStatus) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.scrub = status
+}
+
+func (self *Slave) getScrub() hipstmr.ScrubStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.scrub
+}
+
+// handleRequest handles messages, which slaves send on their own,
+// and returns false for replies to the master.
+func (self *Slave) handleRequest(trans helper.Transaction) bool {
+	switch trans.Action {
+	case "scrub_report":
+		if err := self.master.OnScrubReport(self, trans); err != nil {
+			fmt.Println("Error scrub report:", err)
+		}
+	case "gc_query":
+		if err := self.master.OnGcQuery(self, trans); err != nil {
+			fmt.Println("Error gc query:", err)
+		}
+	case "gc_report":
+		if err := self.master.OnGcReport(self, trans); err != nil {
+			fmt.Println("Error gc report:", err)
+		}
+	case "heartbeat":
+		if err := self.master.OnHeartbeat(self, trans); err != nil {
+			fmt.Println("Error heartbeat:", err)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+func (self *Master) OnScrubReport(slave *Slave, trans helper.Transaction) error {
+	var status hipstmr.ScrubStatus
+	if err := helper.DecodePayload(trans.Payload, &status); err != nil {
+		return err
+	}
+	slave.setScrub(status)
+
+	bad := append(append([]string{}, status.Corrupt...), status.Missing...)
+	// the finished pass knows all the bad chunks
+	self.fsdata.MarkBad(slave.id, bad, !status.Running)
+	if len(bad) != 0 {
+		fmt.Println("Slave", slave.id, "has bad chunks:", bad)
+		go self.repair(slave, bad)
+	}
+	return nil
+}
+
+func (self *Master) startRepair(slave *Slave, chunk string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	key := slave.id + "/" + chunk
+	if self.repairing[key] {
+		return false
+	}
+	self.repairing[key] = true
+	return true
+}
+
+func (self *Master) finishRepair(slave *Slave, chunk string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.repairing, slave.id+"/"+chunk)
+}
+
+// repair copies bad chunks to the slave from healthy replicas
+// by fileservers of the slaves.
+func (self *Master) repair(slave *Slave, chunks []string) {
+	for _, chunk := range chunks {
+		if !self.startRepair(slave, chunk) {
+			continue
+		}
+
+		if err := self.repairChunk(slave, chunk); err != nil {
+			fmt.Println("Error repair:", err)
+		} else {
+			self.fsdata.ClearBad(slave.id, chunk)
+			fmt.Println("Repaired chunk", chunk, "on slave", slave.id)
+		}
+		self.finishRepair(slave, chunk)
+	}
+}
+
+func (self *Master) repairChunk(slave *Slave, chunk string) error {
+	if self.fsdata.IsFull(slave.id) {
+		return errors.New("No space on slave " + slave.id + " to repair chunk " + chunk + ".")
+	}
+	replica, checksum, ok := self.fsdata.FindReplica(slave.id, chunk)
+	if !ok {
+		return errors.New("No healthy replica of chunk " + chunk + " for slave " + slave.id + ".")
+	}
+
+	from, err := self.getSlaves([]string{replica})
+	if err != nil {
+		return err
+	}
+	if from[0].fileserver == "" || slave.fileserver == "" {
+		return errors.New("No fileserver to repair chunk " + chunk + " on slave " + slave.id + ".")
+	}
+
+	return copyChunk(from[0].fileserver, slave.fileserver, chunk, checksum)
+}
+
+// copyChunk asks the fileserver to send the chunk to another one.
+func copyChunk(from, to, chunk string, checksum uint32) error {
+	return sendChunk("copy", from, to, chunk, checksum)
+}
+
+// sendChunk runs the copy or move action of the fileserver for the chunk.
+func sendChunk(action, from, to, chunk string, checksum uint32) error {
+	conn, err := fileserver.Dial(from)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	params := map[string]string{
+		"from": chunk + ".chunk",
+		"addr": to,
+	}
+	if checksum != 0 {
+		params["checksum"] = strconv.FormatUint(uint64(checksum), 16)
+	}
+
+	res, err := conn.Run(fileserver.FileServerCommand{
+		Id:     uuid.New(),
+		Status: "started",
+		Action: action,
+		Params: params,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if res.Status != "finished" {
+		return errors.New("Fileserver " + from + " failed to " + action + " chunk " + chunk + " to " + to + ": " + res.Params["error"])
+	}
+	return nil
+}
+
+// Status describes connected slaves.
+func (self *Master) Status() hipstmr.Status {
+	self.lock.Lock()
+	slaves := make([]*Slave, 0, len(self.slaves))
+	for _, slave := range self.slaves {
+		slaves = append(slaves, slave)
+	}
+	self.lock.Unlock()
+
+	res := hipstmr.Status{
+		Slaves: make([]hipstmr.SlaveStatus, len(slaves)),
+	}
+	for i, slave := range slaves {
+		res.Slaves[i] = hipstmr.SlaveStatus{
+			Id:           slave.id,
+			Fileserver:   slave.fileserver,
+			Machine:      slave.machine,
+			Rack:         slave.rack,
+			Labels:       slave.labels,
+			Chunks:       self.fsdata.ChunksCount(slave.id),
+			Used:         self.fsdata.Used(slave.id),
+			Disks:        slave.getDisks(),
+			Full:         self.fsdata.IsFull(slave.id),
+			Bad:          self.fsdata.GetBad(slave.id),
+			Scrub:        slave.getScrub(),
+			Gc:           slave.getGc(),
+			Decommission: slave.getDecommission(),
+		}
+	}
+	sort.Slice(res.Slaves, func(i, j int) bool {
+		return res.Slaves[i].Id < res.Slaves[j].Id
+	})
+	return res
+}
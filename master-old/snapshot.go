@@ -0,0 +1,86 @@
+package main
+
+import (
+	"HipstMR/lib/go/hipstmr"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// checkWritable rejects changes of snapshots, they are changed only
+// by the snapshot operations.
+func checkWritable(tables []string) error {
+	for _, tbl := range tables {
+		if hipstmr.IsSnapshotTable(tbl) {
+			return errors.New("Snapshot " + tbl + " is read-only.")
+		}
+	}
+	return nil
+}
+
+func (self *Master) Snapshot(tbl, name string) error {
+	if name == "" || strings.Contains(name, "@") || strings.Contains(name, "/") {
+		return errors.New("Bad snapshot name " + name + ".")
+	}
+	if err := checkWritable([]string{tbl}); err != nil {
+		return err
+	}
+	if len(self.fsdata.GetTablesOwners([]string{tbl})) == 0 {
+		return errors.New("Table " + tbl + " doesn't exist.")
+	}
+
+	snapshot := hipstmr.SnapshotTable(tbl, name)
+	if len(self.fsdata.GetTablesOwners([]string{snapshot})) != 0 {
+		return errors.New("Snapshot " + name + " of " + tbl + " already exists.")
+	}
+
+	return self.RunSteps([]*hipstmr.Params{{
+		Type:         "copy",
+		InputTables:  []string{tbl},
+		OutputTables: []string{snapshot},
+	}})
+}
+
+func (self *Master) Snapshots(tbl string) ([]hipstmr.SnapshotInfo, error) {
+	prefix := hipstmr.SnapshotPrefix
+	if tbl != "" {
+		prefix = hipstmr.SnapshotTable(tbl, "")
+	}
+	names := self.fsdata.Tables(prefix)
+	sort.Strings(names)
+
+	res := []hipstmr.SnapshotInfo{}
+	for _, snapshot := range names {
+		orig, name, ok := hipstmr.ParseSnapshotTable(snapshot)
+		if !ok || (tbl != "" && orig != tbl) {
+			continue
+		}
+
+		stat, err := self.fsdata.Stat(snapshot)
+		if err != nil {
+			// dropped in the meantime
+			continue
+		}
+		res = append(res, hipstmr.SnapshotInfo{
+			Table:  orig,
+			Name:   name,
+			Chunks: stat.Chunks,
+			Size:   stat.Size,
+		})
+	}
+	return res, nil
+}
+
+// DropSnapshot removes the snapshot for good, chunks shared with
+// the table or other snapshots stay.
+func (self *Master) DropSnapshot(tbl, name string) error {
+	snapshot := hipstmr.SnapshotTable(tbl, name)
+	if len(self.fsdata.GetTablesOwners([]string{snapshot})) == 0 {
+		return errors.New("Snapshot " + name + " of " + tbl + " doesn't exist.")
+	}
+
+	return self.RunSteps([]*hipstmr.Params{{
+		Type:        "drop",
+		InputTables: []string{snapshot},
+	}})
+}
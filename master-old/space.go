@@ -0,0 +1,79 @@
+package main
+
+import (
+	"HipstMR/helper"
+	"HipstMR/lib/go/hipstmr"
+	"fmt"
+)
+
+// SetAvailable remembers space above the reserve on the disks of the slave.
+func (self *FsData) SetAvailable(id string, bytes uint64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.available[id] = bytes
+}
+
+// hasSpace tells if the chunk of the size fits on the slave. Slaves,
+// which didn't report their space yet, are assumed to have it.
+func (self *FsData) hasSpace(id string, size uint64) bool {
+	available, ok := self.available[id]
+	return !ok || (available > 0 && available >= size)
+}
+
+func (self *FsData) full(id string) bool {
+	return !self.hasSpace(id, 0)
+}
+
+// findSpaciousReplica returns another allowed slave, which has a healthy
+// copy of the chunk, isn't draining and has space for outputs.
+func (self *FsData) findSpaciousReplica(id, chunk string, allowed IdSet) (string, bool) {
+	for slave, fsData := range self.slaves {
+		if slave == id || self.bad[slave][chunk] || self.draining[slave] || self.full(slave) || (allowed != nil && !allowed[slave]) {
+			continue
+		}
+		if _, ok := fsData.Chunks[chunk]; ok {
+			return slave, true
+		}
+	}
+	return "", false
+}
+
+func (self *Slave) setDisks(disks []hipstmr.DiskStatus) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.disks = disks
+}
+
+func (self *Slave) getDisks() []hipstmr.DiskStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]hipstmr.DiskStatus{}, self.disks...)
+}
+
+// OnHeartbeat updates space of the slave disks. A single output is
+// written to one disk, so the slave is full when none has space.
+func (self *Master) OnHeartbeat(slave *Slave, trans helper.Transaction) error {
+	var disks []hipstmr.DiskStatus
+	if err := helper.DecodePayload(trans.Payload, &disks); err != nil {
+		return err
+	}
+
+	var available uint64 = 0
+	for _, disk := range disks {
+		if !disk.Failed && disk.Available > available {
+			available = disk.Available
+		}
+	}
+	if available == 0 && !self.fsdata.IsFull(slave.id) {
+		fmt.Println("Slave", slave.id, "is full")
+	}
+	slave.setDisks(disks)
+	self.fsdata.SetAvailable(slave.id, available)
+	return nil
+}
+
+func (self *FsData) IsFull(id string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.full(id)
+}
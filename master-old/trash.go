@@ -0,0 +1,170 @@
+package main
+
+import (
+	"HipstMR/lib/go/hipstmr"
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const trashPrefix = ".trash/"
+
+const trashCheckInterval = 10 * time.Minute
+
+// trashName names a dropped table, the time of the drop keeps versions
+// of the same table apart.
+func trashName(tbl string, t time.Time) string {
+	return trashPrefix + tbl + "@" + strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func parseTrashName(name string) (string, time.Time, bool) {
+	if !strings.HasPrefix(name, trashPrefix) {
+		return "", time.Time{}, false
+	}
+	pos := strings.LastIndex(name, "@")
+	if pos < len(trashPrefix) {
+		return "", time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(name[pos+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return name[len(trashPrefix):pos], time.Unix(0, ns), true
+}
+
+// Tables returns names of the tables starting with the prefix.
+func (self *FsData) Tables(prefix string) []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := []string{}
+	for tbl, _ := range self.index {
+		if strings.HasPrefix(tbl, prefix) {
+			res = append(res, tbl)
+		}
+	}
+	return res
+}
+
+// toTrash replaces drops of tables with moves to the trash. Temporary
+// tables and the ones already in the trash are dropped for good, as well
+// as all the tables if there is no retention.
+func (self *Master) toTrash(steps []*hipstmr.Params) []*hipstmr.Params {
+	if self.retention <= 0 {
+		return steps
+	}
+
+	now := time.Now()
+	res := make([]*hipstmr.Params, 0, len(steps))
+	for _, p := range steps {
+		if p.Type != "drop" {
+			res = append(res, p)
+			continue
+		}
+
+		purge := []string{}
+		for _, tbl := range p.InputTables {
+			if strings.HasPrefix(tbl, trashPrefix) || strings.HasPrefix(tbl, "tmp/") {
+				purge = append(purge, tbl)
+				continue
+			}
+
+			// a table may be dropped several times in a transaction
+			now = now.Add(time.Nanosecond)
+			res = append(res, &hipstmr.Params{
+				Type:         "move",
+				InputTables:  []string{tbl},
+				OutputTables: []string{trashName(tbl, now)},
+			})
+		}
+		if len(purge) != 0 {
+			res = append(res, &hipstmr.Params{
+				Type:        "drop",
+				InputTables: purge,
+			})
+		}
+	}
+	return res
+}
+
+func (self *Master) Undrop(tbl string) error {
+	last := ""
+	var lastTime time.Time
+	for _, name := range self.fsdata.Tables(trashPrefix) {
+		orig, t, ok := parseTrashName(name)
+		if ok && orig == tbl && (last == "" || t.After(lastTime)) {
+			last, lastTime = name, t
+		}
+	}
+	if last == "" {
+		return errors.New("Table " + tbl + " is not in the trash.")
+	}
+	if len(self.fsdata.GetTablesOwners([]string{tbl})) != 0 {
+		return errors.New("Table " + tbl + " already exists.")
+	}
+
+	// purge of the trash may drop the table meanwhile
+	id := uuid.New()
+	if err := self.locks.Lock(id, "undrop", nil, []string{last}, true, nil); err != nil {
+		return err
+	}
+	defer self.locks.Unlock(id)
+	if len(self.fsdata.GetTablesOwners([]string{last})) == 0 {
+		return errors.New("Table " + tbl + " is not in the trash.")
+	}
+
+	return self.RunSteps([]*hipstmr.Params{{
+		Type:         "move",
+		InputTables:  []string{last},
+		OutputTables: []string{tbl},
+	}})
+}
+
+// purgeTrash drops tables, which were moved to the trash before the time.
+func (self *Master) purgeTrash(before time.Time, wait bool) error {
+	tables := []string{}
+	for _, name := range self.fsdata.Tables(trashPrefix) {
+		if _, t, ok := parseTrashName(name); !ok || t.Before(before) {
+			tables = append(tables, name)
+		}
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+
+	// jobs may still read dropped tables
+	id := uuid.New()
+	if err := self.locks.Lock(id, "purge_trash", nil, tables, wait, nil); err != nil {
+		return err
+	}
+	defer self.locks.Unlock(id)
+
+	fmt.Println("Purge trash:", tables)
+	return self.RunSteps([]*hipstmr.Params{{
+		Type:        "drop",
+		InputTables: tables,
+	}})
+}
+
+func (self *Master) EmptyTrash(wait bool) error {
+	return self.purgeTrash(time.Now(), wait)
+}
+
+// PurgeTrash drops tables, which are in the trash longer than
+// the retention period.
+func (self *Master) PurgeTrash() {
+	interval := trashCheckInterval
+	if self.retention < interval {
+		interval = self.retention
+	}
+
+	for {
+		time.Sleep(interval)
+		if err := self.purgeTrash(time.Now().Add(-self.retention), false); err != nil {
+			fmt.Println("Error purge trash:", err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"HipstMR/helper"
+	"HipstMR/lib/go/hipstmr"
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const ttlCheckInterval = time.Minute
+
+// expireSteps turns ttls of tables into expiration times. All the slaves
+// get the same time, so it is computed here.
+func expireSteps(p *hipstmr.Params) []helper.Step {
+	now := time.Now()
+	res := []helper.Step{}
+	for tbl, ttl := range p.Ttl {
+		var expires int64 = 0
+		if ttl > 0 {
+			expires = now.Add(ttl).Unix()
+		}
+		res = append(res, helper.Step{
+			Action: "fs_set_expire",
+			Params: helper.Params{
+				Params: &hipstmr.Params{
+					InputTables: []string{tbl},
+				},
+				Expires: expires,
+			},
+		})
+	}
+	return res
+}
+
+// getExpires returns the earliest expiration time of the table among
+// slaves owning it.
+func (self *FsData) getExpires(tbl string) int64 {
+	var res int64 = 0
+	for slave, _ := range self.index[tbl] {
+		if e, ok := self.slaves[slave].Expires[tbl]; ok && (res == 0 || e < res) {
+			res = e
+		}
+	}
+	return res
+}
+
+func (self *FsData) Stat(tbl string) (hipstmr.TableStat, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	tagData, ok := self.index[tbl]
+	if !ok {
+		return hipstmr.TableStat{}, errors.New("Table " + tbl + " doesn't exist.")
+	}
+
+	// replicas are counted once
+	sizes := make(map[string]uint64)
+	for slave, chunks := range tagData {
+		for chunk, _ := range chunks {
+			sizes[chunk] = self.slaves[slave].Chunks[chunk].Size
+		}
+	}
+
+	res := hipstmr.TableStat{
+		Name:    tbl,
+		Chunks:  len(sizes),
+		Slaves:  len(tagData),
+		Expires: self.getExpires(tbl),
+	}
+	for _, size := range sizes {
+		res.Size += size
+	}
+	for pin, _ := range self.index {
+		if orig, ok := pinnedTable(pin); ok && orig == tbl {
+			res.Readers++
+		}
+	}
+	if res.Expires != 0 {
+		res.Ttl = time.Unix(res.Expires, 0).Sub(time.Now())
+		if res.Ttl < 0 {
+			res.Ttl = 0
+		}
+	}
+	return res, nil
+}
+
+// Expired returns tables, which expire by the time.
+func (self *FsData) Expired(now time.Time) []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := []string{}
+	for tbl, _ := range self.index {
+		if e := self.getExpires(tbl); e != 0 && e <= now.Unix() {
+			res = append(res, tbl)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (self *Master) SetTtl(tbl string, ttl time.Duration) error {
+	owners := self.fsdata.GetTablesOwners([]string{tbl})
+	if len(owners) == 0 {
+		return errors.New("Table " + tbl + " doesn't exist.")
+	}
+
+	steps := expireSteps(&hipstmr.Params{
+		Ttl: map[string]time.Duration{tbl: ttl},
+	})
+	slavesSteps := make(map[string][]helper.Step)
+	for _, k := range owners {
+		slavesSteps[k] = steps
+	}
+	return self.RunTwoPhase(slavesSteps)
+}
+
+// expireTable doesn't wait for operations using the table, it is retried
+// on the next check.
+func (self *Master) expireTable(tbl string) error {
+	id := uuid.New()
+	if err := self.locks.Lock(id, "expire", nil, []string{tbl}, false, nil); err != nil {
+		return err
+	}
+	defer self.locks.Unlock(id)
+
+	drop := &hipstmr.Params{
+		Type:        "drop",
+		InputTables: []string{tbl},
+	}
+	return self.RunSteps(self.toTrash([]*hipstmr.Params{drop}))
+}
+
+// ExpireTables drops expired tables, or moves them to the trash
+// if dropped tables are kept.
+func (self *Master) ExpireTables() {
+	for {
+		time.Sleep(ttlCheckInterval)
+		for _, tbl := range self.fsdata.Expired(time.Now()) {
+			if err := self.expireTable(tbl); err != nil {
+				fmt.Println("Error expire table:", tbl, err)
+			} else if self.retention > 0 {
+				fmt.Println("Table", tbl, "expired, moved to trash")
+			} else {
+				fmt.Println("Table", tbl, "expired, dropped")
+			}
+		}
+	}
+}
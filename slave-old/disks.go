@@ -0,0 +1,145 @@
+package main
+
+import (
+	"HipstMR/helper"
+	"HipstMR/lib/go/hipstmr"
+	"HipstMR/utils"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+)
+
+// Disks are the mount points of the slave. A disk is failed while its
+// file system can't be queried, chunks are served from the other ones.
+// New outputs are not written to a disk, if less than reserve bytes
+// would be left free there.
+type Disks struct {
+	mnts    []string
+	failed  map[string]bool
+	reserve uint64
+	lock    sync.Mutex
+}
+
+// noSpaceError is reported to masters with "no_space" status.
+type noSpaceError struct {
+	error
+}
+
+func chunkPath(disk, chunk string) string {
+	return path.Join(disk, chunk+".chunk")
+}
+
+func (self *Disks) setFailed(mnt string, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err != nil && !self.failed[mnt] {
+		fmt.Println("Error disk:", mnt, "failed:", err)
+		self.failed[mnt] = true
+	} else if err == nil && self.failed[mnt] {
+		fmt.Println("Disk", mnt, "is back")
+		delete(self.failed, mnt)
+	}
+}
+
+// Check queries space of every disk.
+func (self *Disks) Check() []hipstmr.DiskStatus {
+	res := make([]hipstmr.DiskStatus, len(self.mnts))
+	for i, mnt := range self.mnts {
+		free, total, err := utils.DiskSpace(mnt)
+		if err == nil {
+			_, err = os.Stat(mnt)
+		}
+		self.setFailed(mnt, err)
+
+		res[i] = hipstmr.DiskStatus{
+			Mnt:    mnt,
+			Failed: err != nil,
+		}
+		if err == nil {
+			res[i].Total = total
+			res[i].Free = free
+			if free > self.reserve {
+				res[i].Available = free - self.reserve
+			}
+		}
+	}
+	return res
+}
+
+// Healthy returns the disks, which are not known to be failed.
+func (self *Disks) Healthy() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := []string{}
+	for _, mnt := range self.mnts {
+		if !self.failed[mnt] {
+			res = append(res, mnt)
+		}
+	}
+	return res
+}
+
+// Pick returns the healthy disk with the most free space for new chunks
+// of about need bytes.
+func (self *Disks) Pick(need uint64) (string, error) {
+	self.Check()
+	res, available, err := utils.MostAvailable(self.Healthy(), self.reserve)
+	if err != nil {
+		return "", errors.New("No healthy disks.")
+	}
+	if available == 0 || available < need {
+		return "", noSpaceError{errors.New("No space left on " + helper.Hostname() + ": " + strconv.FormatUint(need, 10) + " bytes needed, " + strconv.FormatUint(available, 10) + " available.")}
+	}
+	return res, nil
+}
+
+// isFull tells if the disk has no space above the reserve.
+func (self *Disks) isFull(mnt string) bool {
+	free, err := utils.FreeSpace(mnt)
+	return err == nil && free <= self.reserve
+}
+
+// Find returns the disk the chunk file is on, starting with the recorded
+// one. An empty string is returned, if no healthy disk has it.
+func (self *Disks) Find(chunk, disk string) string {
+	mnts := self.Healthy()
+	if disk != "" {
+		mnts = append([]string{disk}, mnts...)
+	}
+	for _, mnt := range mnts {
+		if self.isFailed(mnt) {
+			continue
+		}
+		_, err := os.Stat(chunkPath(mnt, chunk))
+		if err == nil {
+			return mnt
+		}
+		if !os.IsNotExist(err) {
+			self.setFailed(mnt, err)
+		}
+	}
+	return ""
+}
+
+func (self *Disks) isFailed(mnt string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.failed[mnt]
+}
+
+func NewDisks(mnts []string, reserve uint64) *Disks {
+	res := &Disks{
+		mnts:    make([]string, 0, len(mnts)),
+		failed:  make(map[string]bool),
+		reserve: reserve,
+	}
+	for _, mnt := range mnts {
+		res.mnts = append(res.mnts, path.Clean(mnt))
+	}
+	return res
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"HipstMR/helper"
+	"HipstMR/lib/go/hipstmr"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tmpTransaction returns the transaction of a temporary table, they are
+// named tmp/<transaction>/<table>, or .pin/<transaction>/<table> for
+// versions of tables read by jobs.
+func tmpTransaction(tag string) (string, bool) {
+	parts := strings.Split(tag, "/")
+	if len(parts) < 3 || (parts[0] != "tmp" && parts[0] != ".pin") {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// diskEntry is a file or a directory in the root of a disk.
+type diskEntry struct {
+	mnt  string
+	info os.FileInfo
+}
+
+// scanDisks lists the healthy disks. Chunks of disks, which can't be
+// read, are reported missing.
+func (self *FsData) scanDisks() []diskEntry {
+	res := []diskEntry{}
+	for _, mnt := range self.disks.Healthy() {
+		entries, err := ioutil.ReadDir(mnt)
+		if err != nil {
+			self.disks.setFailed(mnt, err)
+			continue
+		}
+		for _, v := range entries {
+			res = append(res, diskEntry{mnt, v})
+		}
+	}
+	return res
+}
+
+// Fsck compares metadata with chunk files on the disks and sends found
+// issues in the payload. Orphan files and temporary data of transactions,
+// which are not active on the master, are removed in repair mode. Orphans
+// and directories younger than grace are skipped as gc does, they may be
+// chunks being copied in by fileservers. The disks are scanned without
+// the lock, so chunks added meanwhile are looked up again.
+func (self *FsData) Fsck(trans *helper.Transaction, grace time.Duration) error {
+	entries := self.scanDisks()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	repair := trans.Params.Repair
+	active := make(map[string]bool)
+	for _, id := range trans.Params.Active {
+		active[id] = true
+	}
+
+	issues := []hipstmr.FsckIssue{}
+	sizes := make(map[string]int64)
+	disks := make(map[string]string)
+	for _, entry := range entries {
+		mnt, v := entry.mnt, entry.info
+		nm := v.Name()
+		young := time.Since(v.ModTime()) < grace
+		if v.IsDir() {
+			// jobs write their output to directories named by transactions
+			if young || active[nm] || self.running[nm] > 0 {
+				continue
+			}
+			issue := hipstmr.FsckIssue{
+				Kind:    "tmp",
+				Details: "directory " + nm,
+			}
+			if repair {
+				issue.Repaired = os.RemoveAll(path.Join(mnt, nm)) == nil
+			}
+			issues = append(issues, issue)
+			continue
+		}
+
+		if !strings.HasSuffix(nm, ".chunk") {
+			continue
+		}
+		id := strings.TrimSuffix(nm, ".chunk")
+		if _, ok := self.data.Chunks[id]; ok {
+			sizes[id] = v.Size()
+			disks[id] = mnt
+			continue
+		}
+		if young {
+			continue
+		}
+
+		issue := hipstmr.FsckIssue{
+			Kind:  "orphan",
+			Chunk: id,
+		}
+		if repair {
+			issue.Repaired = os.Remove(path.Join(mnt, nm)) == nil
+		}
+		issues = append(issues, issue)
+	}
+
+	mark := self.data.Mark()
+	ids := make([]string, 0, len(self.data.Chunks))
+	for id, _ := range self.data.Chunks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		data := self.data.Chunks[id]
+		table := ""
+		for tag, _ := range data.Tags {
+			if table == "" || tag < table {
+				table = tag
+			}
+		}
+
+		size, ok := sizes[id]
+		if !ok {
+			// the chunk may be added after its disk was scanned
+			if disk := self.disks.Find(id, data.Disk); disk != "" {
+				if info, err := os.Stat(chunkPath(disk, id)); err == nil {
+					size, ok = info.Size(), true
+					disks[id] = disk
+				}
+			}
+		}
+		if !ok {
+			issues = append(issues, hipstmr.FsckIssue{
+				Kind:  "missing",
+				Table: table,
+				Chunk: id,
+			})
+		} else if data.Size != 0 && uint64(size) != data.Size {
+			issues = append(issues, hipstmr.FsckIssue{
+				Kind:    "size",
+				Table:   table,
+				Chunk:   id,
+				Details: fmt.Sprintf("%d bytes instead of %d", size, data.Size),
+			})
+		} else if data.Disk != "" && disks[id] != data.Disk {
+			issue := hipstmr.FsckIssue{
+				Kind:    "disk",
+				Table:   table,
+				Chunk:   id,
+				Details: "on " + disks[id] + " instead of " + data.Disk,
+			}
+			if repair {
+				self.data.SetDisk(id, disks[id])
+				issue.Repaired = true
+			}
+			issues = append(issues, issue)
+		}
+	}
+
+	for _, tag := range self.data.Tags() {
+		if id, ok := tmpTransaction(tag); !ok || active[id] {
+			continue
+		}
+
+		issue := hipstmr.FsckIssue{
+			Kind:  "tmp",
+			Table: tag,
+		}
+		if repair {
+			if err := self.Del([]string{tag}); err != nil {
+				self.data.Undo(mark)
+				return err
+			}
+			issue.Repaired = true
+		}
+		issues = append(issues, issue)
+	}
+
+	if err := self.Flush(); err != nil {
+		return err
+	}
+
+	trans.Payload = issues
+	return nil
+}
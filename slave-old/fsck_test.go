@@ -0,0 +1,89 @@
+package main
+
+import (
+	"HipstMR/helper"
+	"HipstMR/lib/go/hipstmr"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// newTestFsData makes metadata of a slave with a single disk in
+// a temporary directory.
+func newTestFsData(t *testing.T) (*FsData, string) {
+	dir := t.TempDir()
+	mnt := path.Join(dir, "data")
+	if err := os.Mkdir(mnt, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	fsdata := NewFsData([]string{mnt}, dir, 0)
+	return &fsdata, mnt
+}
+
+// writeChunk puts a chunk file on the disk, old ones are modified
+// long ago.
+func writeChunk(t *testing.T, mnt, id string, old bool) {
+	name := chunkPath(mnt, id)
+	if err := ioutil.WriteFile(name, []byte(id), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if old {
+		past := time.Now().Add(-2 * time.Hour)
+		if err := os.Chtimes(name, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func runFsck(t *testing.T, fsdata *FsData, repair bool) map[string]hipstmr.FsckIssue {
+	trans := helper.NewTransaction("fs_fsck")
+	trans.Params.Repair = repair
+	if err := fsdata.Fsck(&trans, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	res := make(map[string]hipstmr.FsckIssue)
+	for _, issue := range trans.Payload.([]hipstmr.FsckIssue) {
+		res[issue.Chunk] = issue
+	}
+	return res
+}
+
+func TestFsckFreshChunk(t *testing.T) {
+	fsdata, mnt := newTestFsData(t)
+
+	// outputs of jobs and copies by fileservers are younger than the grace
+	writeChunk(t, mnt, "fresh", false)
+	fsdata.lock.Lock()
+	fsdata.AddChunk("fresh", mnt, "t", 0, uint64(len("fresh")), 0)
+	err := fsdata.Flush()
+	fsdata.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeChunk(t, mnt, "young-orphan", false)
+	writeChunk(t, mnt, "old-orphan", true)
+
+	issues := runFsck(t, fsdata, true)
+	if issue, ok := issues["fresh"]; ok {
+		t.Errorf("fresh chunk is reported: %+v", issue)
+	}
+	if issue, ok := issues["young-orphan"]; ok {
+		t.Errorf("orphan younger than the grace is reported: %+v", issue)
+	}
+	if issue := issues["old-orphan"]; issue.Kind != "orphan" || !issue.Repaired {
+		t.Errorf("old orphan is reported as %+v", issue)
+	}
+	if len(issues) != 1 {
+		t.Errorf("unexpected issues: %+v", issues)
+	}
+
+	if _, err := os.Stat(chunkPath(mnt, "fresh")); err != nil {
+		t.Error("fresh chunk is removed:", err)
+	}
+	if _, err := os.Stat(chunkPath(mnt, "old-orphan")); !os.IsNotExist(err) {
+		t.Error("old orphan is left:", err)
+	}
+}
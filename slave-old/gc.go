@@ -0,0 +1,201 @@
+package main
+
+import (
+	"HipstMR/helper"
+	"HipstMR/lib/go/hipstmr"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const gcQueryTimeout = 30 * time.Second
+
+// Collector periodically removes data left by failed transactions: job
+// directories and temporary tables of transactions, which masters report
+// as finished or dead, and chunk files unknown to the metadata.
+type Collector struct {
+	slave    *Slave
+	interval time.Duration
+	grace    time.Duration
+	dryRun   bool
+	status   hipstmr.GcStatus
+}
+
+func (self *Collector) Run() {
+	for {
+		time.Sleep(self.interval)
+		if err := self.collect(); err != nil {
+			fmt.Println("Error gc:", err)
+		}
+	}
+}
+
+// activeTransactions asks all the masters, nothing may be removed
+// if one of them doesn't answer.
+func (self *Collector) activeTransactions() (map[string]bool, error) {
+	masters := self.slave.getMasters()
+	if len(masters) == 0 {
+		return nil, errors.New("No masters to ask for active transactions.")
+	}
+
+	res := make(map[string]bool)
+	for _, master := range masters {
+		tr, err := master.Query(helper.NewTransaction("gc_query"), gcQueryTimeout)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range tr.Params.Active {
+			res[id] = true
+		}
+	}
+	return res, nil
+}
+
+func (self *Collector) collect() error {
+	since := time.Now()
+	active, err := self.activeTransactions()
+	if err != nil {
+		return err
+	}
+
+	stats, err := self.slave.fsdata.CollectGarbage(active, since, self.grace, self.dryRun)
+	if err != nil {
+		return err
+	}
+
+	self.status.Runs++
+	self.status.Last = time.Now().Unix()
+	self.status.DryRun = self.dryRun
+	self.status.LastRun = stats
+	self.status.Total.Dirs += stats.Dirs
+	self.status.Total.Chunks += stats.Chunks
+	self.status.Total.Tables += stats.Tables
+	self.status.Total.Bytes += stats.Bytes
+	fmt.Println("Gc:", stats.Bytes, "bytes,", stats.Dirs, "dirs,", stats.Chunks, "chunks,", stats.Tables, "tables")
+
+	self.slave.ReportGc(self.status)
+	return nil
+}
+
+func dirSize(name string) uint64 {
+	var res uint64 = 0
+	filepath.Walk(name, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			res += uint64(info.Size())
+		}
+		return nil
+	})
+	return res
+}
+
+// CollectGarbage removes directories and temporary tables of transactions,
+// which are not active and had no jobs on the slave since masters were
+// asked about them, and orphan chunk files older than grace.
+func (self *FsData) CollectGarbage(active map[string]bool, since time.Time, grace time.Duration, dryRun bool) (hipstmr.GcStats, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for id, t := range self.finished {
+		if t.Before(since) {
+			delete(self.finished, id)
+		}
+	}
+	live := func(id string) bool {
+		_, ok := self.finished[id]
+		return ok || active[id] || self.running[id] > 0
+	}
+
+	verb := "Gc: remove"
+	if dryRun {
+		verb = "Gc: would remove"
+	}
+
+	var stats hipstmr.GcStats
+	for _, mnt := range self.disks.Healthy() {
+		entries, err := ioutil.ReadDir(mnt)
+		if err != nil {
+			self.disks.setFailed(mnt, err)
+			continue
+		}
+
+		for _, v := range entries {
+			nm := v.Name()
+			p := path.Join(mnt, nm)
+			if v.IsDir() {
+				if live(nm) {
+					continue
+				}
+				size := dirSize(p)
+				fmt.Println(verb, "directory", p)
+				if !dryRun {
+					if err := os.RemoveAll(p); err != nil {
+						fmt.Println("Error gc:", err)
+						continue
+					}
+				}
+				stats.Dirs++
+				stats.Bytes += size
+				continue
+			}
+
+			if !strings.HasSuffix(nm, ".chunk") {
+				continue
+			}
+			if _, ok := self.data.Chunks[strings.TrimSuffix(nm, ".chunk")]; ok || time.Since(v.ModTime()) < grace {
+				continue
+			}
+			fmt.Println(verb, "orphan chunk", p)
+			if !dryRun {
+				if err := os.Remove(p); err != nil {
+					fmt.Println("Error gc:", err)
+					continue
+				}
+			}
+			stats.Chunks++
+			stats.Bytes += uint64(v.Size())
+		}
+	}
+
+	mark := self.data.Mark()
+	for _, tag := range self.data.Tags() {
+		id, ok := tmpTransaction(tag)
+		if !ok || live(id) {
+			continue
+		}
+		fmt.Println(verb, "table", tag)
+		if err := self.Del([]string{tag}); err != nil {
+			self.data.Undo(mark)
+			return stats, err
+		}
+		stats.Tables++
+	}
+
+	for _, m := range self.data.Pending()[mark:] {
+		if m.Op != "del_chunk" {
+			continue
+		}
+		if info, err := os.Stat(self.chunkFileName(m.Chunk)); err == nil {
+			stats.Bytes += uint64(info.Size())
+		}
+	}
+
+	if dryRun {
+		self.data.Undo(mark)
+		return stats, nil
+	}
+	return stats, self.Flush()
+}
+
+func NewCollector(slave *Slave, interval, grace time.Duration, dryRun bool) *Collector {
+	return &Collector{
+		slave:    slave,
+		interval: interval,
+		grace:    grace,
+		dryRun:   dryRun,
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"HipstMR/helper"
+	"HipstMR/lib/go/hipstmr"
+	"HipstMR/utils"
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+)
+
+// appendChunk copies the chunk to the writer verifying its checksum.
+func (self *FsData) appendChunk(w io.Writer, chunk string, cfg JobConfig) error {
+	f, err := os.Open(cfg.Files[chunk])
+	if err != nil {
+		return errors.New("Chunk " + chunk + " on " + cfg.Host + ": " + err.Error())
+	}
+	defer f.Close()
+
+	hash := crc32.New(utils.Castagnoli)
+	if _, err := io.Copy(io.MultiWriter(w, hash), f); err != nil {
+		return err
+	}
+	if sum, ok := cfg.Checksums[chunk]; ok && sum != hash.Sum32() {
+		return errors.New("Chunk " + chunk + " on " + cfg.Host + " is corrupted: checksum mismatch.")
+	}
+	return nil
+}
+
+// writeMerged concatenates the chunks in the given order into chunks of
+// about the chunk size. Chunks are not split, so records stay whole.
+// Checksums of the new chunks are put next to them as jobs do. Chunks of
+// at least the chunk size are not copied, they are returned with their
+// numbers among the new ones.
+func (self *FsData) writeMerged(cfg JobConfig) (map[string]uint64, error) {
+	dir := path.Join(cfg.Mnt, cfg.Dir, cfg.OutputTables[0])
+	if err := os.MkdirAll(dir, os.ModeDir|os.ModeTemporary|os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	var out *os.File = nil
+	var sum hash.Hash32 = nil
+	var written int64 = 0
+	num := 0
+	kept := make(map[string]uint64)
+	defer func() {
+		if out != nil {
+			out.Close()
+		}
+	}()
+	closeOut := func() error {
+		err := out.Close()
+		name := out.Name()
+		out = nil
+		if err != nil {
+			return err
+		}
+		return utils.WriteChecksum(name, sum.Sum32())
+	}
+
+	for _, chunk := range cfg.Chunks {
+		name, ok := cfg.Files[chunk]
+		if !ok {
+			return nil, errors.New("Chunk " + chunk + " on " + cfg.Host + " is not found on healthy disks.")
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, errors.New("Chunk " + chunk + " on " + cfg.Host + ": " + err.Error())
+		}
+
+		// a chunk has one number in the output, so its repeats are copied
+		if _, ok := kept[chunk]; !ok && info.Size() >= cfg.ChunkSize {
+			if out != nil {
+				if err := closeOut(); err != nil {
+					return nil, err
+				}
+			}
+			kept[chunk] = uint64(num)
+			num++
+			continue
+		}
+
+		if out != nil && written > 0 && written+info.Size() > cfg.ChunkSize {
+			if err := closeOut(); err != nil {
+				return nil, err
+			}
+		}
+		if out == nil {
+			if out, err = os.Create(path.Join(dir, fmt.Sprintf("%d.chunk", num))); err != nil {
+				return nil, err
+			}
+			sum = crc32.New(utils.Castagnoli)
+			num++
+			written = 0
+		}
+
+		if err := self.appendChunk(io.MultiWriter(out, sum), chunk, cfg); err != nil {
+			return nil, err
+		}
+		written += info.Size()
+	}
+
+	if out == nil {
+		return kept, nil
+	}
+	return kept, closeOut()
+}
+
+// registerMerged adds the merged chunks and tags the kept ones with their
+// numbers in the output table.
+func (self *FsData) registerMerged(cfg JobConfig, kept map[string]uint64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	mark := self.data.Mark()
+	if err := self.addOutputs(cfg); err != nil {
+		self.data.Undo(mark)
+		return err
+	}
+	for chunk, num := range kept {
+		if _, ok := self.data.Chunks[chunk]; !ok {
+			self.data.Undo(mark)
+			return errors.New("Chunk " + chunk + " on " + cfg.Host + " is removed while merging.")
+		}
+		self.data.AddTag(chunk, cfg.OutputTables[0], num)
+	}
+	return self.Flush()
+}
+
+// DoMerge rewrites chunks of a table, which follow one another on this
+// slave, into bigger ones registered in the output table.
+func (self *FsData) DoMerge(trans *helper.Transaction) error {
+	self.startJob(trans.Id)
+	defer self.finishJob(trans.Id)
+
+	disk, err := self.disks.Pick(self.inputSize(trans.Params.Chunks))
+	if err != nil {
+		return err
+	}
+
+	cfg := JobConfig{
+		Mnt:          disk,
+		Dir:          path.Join(trans.Id, uuid.New()),
+		Chunks:       trans.Params.Chunks,
+		OutputTables: trans.Params.OutputTables,
+		Checksums:    self.checksums(trans.Params.Chunks),
+		Files:        self.chunkFiles(trans.Params.Chunks),
+		Host:         helper.Hostname(),
+		ChunkSize:    hipstmr.DefaultChunkSize,
+	}
+	if trans.Params.Params != nil && trans.Params.Params.ChunkSize > 0 {
+		cfg.ChunkSize = trans.Params.Params.ChunkSize
+	}
+	if len(cfg.OutputTables) != 1 {
+		return errors.New("Merge needs exactly one output table.")
+	}
+	defer os.RemoveAll(path.Join(disk, trans.Id))
+
+	kept, err := self.writeMerged(cfg)
+	if err != nil {
+		if utils.IsNoSpace(err) {
+			return noSpaceError{errors.New("No space left on " + cfg.Host + " for merged chunks.")}
+		}
+		return err
+	}
+	return self.registerMerged(cfg, kept)
+}
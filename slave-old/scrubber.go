@@ -0,0 +1,144 @@
+package main
+
+import (
+	"HipstMR/lib/go/hipstmr"
+	"HipstMR/utils"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const scrubBlock = 1 << 20
+
+// Scrubber rereads chunks in the background at limited bandwidth and
+// verifies their checksums. Findings are reported to masters once a chunk
+// is found bad and at the end of every pass.
+type Scrubber struct {
+	fsdata   *FsData
+	rate     int64
+	interval time.Duration
+	report   func(hipstmr.ScrubStatus)
+	status   hipstmr.ScrubStatus
+	lock     sync.Mutex
+}
+
+func (self *Scrubber) Status() hipstmr.ScrubStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	res := self.status
+	res.Corrupt = append([]string{}, self.status.Corrupt...)
+	res.Missing = append([]string{}, self.status.Missing...)
+	return res
+}
+
+func (self *Scrubber) Run() {
+	for {
+		self.pass()
+		time.Sleep(self.interval)
+	}
+}
+
+func (self *Scrubber) pass() {
+	ids := self.fsdata.chunkIds()
+	sort.Strings(ids)
+	sums := self.fsdata.checksums(ids)
+
+	self.lock.Lock()
+	self.status.Checked = 0
+	self.status.Total = uint64(len(ids))
+	self.status.Bytes = 0
+	self.status.Corrupt = []string{}
+	self.status.Missing = []string{}
+	self.status.Started = time.Now().Unix()
+	self.status.Running = true
+	self.lock.Unlock()
+
+	start := time.Now()
+	var bytes int64 = 0
+	for _, id := range ids {
+		sum, known := sums[id]
+		n, ok, err := self.verify(id, sum, known, start, bytes)
+		bytes += n
+
+		missing := os.IsNotExist(err)
+		corrupt := !missing && !ok
+		if (missing || corrupt) && !self.fsdata.hasChunk(id) {
+			// the chunk was deleted in the meantime
+			missing, corrupt = false, false
+		}
+
+		self.lock.Lock()
+		self.status.Checked++
+		self.status.Bytes = uint64(bytes)
+		if missing {
+			self.status.Missing = append(self.status.Missing, id)
+		} else if corrupt {
+			self.status.Corrupt = append(self.status.Corrupt, id)
+		}
+		self.lock.Unlock()
+
+		if missing || corrupt {
+			fmt.Println("Error scrub: chunk", id, "is bad:", err)
+			self.report(self.Status())
+		}
+	}
+
+	self.lock.Lock()
+	self.status.Passes++
+	self.status.Finished = time.Now().Unix()
+	self.status.Running = false
+	self.lock.Unlock()
+	self.report(self.Status())
+}
+
+// verify reads the chunk no faster than the rate allows, taking into
+// account bytes already read in this pass. Only existence of chunks without
+// a known checksum is checked.
+func (self *Scrubber) verify(id string, sum uint32, known bool, start time.Time, done int64) (int64, bool, error) {
+	f, err := os.Open(self.fsdata.GetChunkFileName(id))
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	if !known {
+		return 0, true, nil
+	}
+
+	hash := crc32.New(utils.Castagnoli)
+	var n int64 = 0
+	for {
+		cnt, err := io.CopyN(hash, f, scrubBlock)
+		n += cnt
+		if self.rate > 0 {
+			ahead := time.Duration(done+n)*time.Second/time.Duration(self.rate) - time.Since(start)
+			if ahead > 0 {
+				time.Sleep(ahead)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, false, err
+		}
+	}
+	return n, hash.Sum32() == sum, nil
+}
+
+func NewScrubber(fsdata *FsData, rate int64, interval time.Duration, report func(hipstmr.ScrubStatus)) *Scrubber {
+	return &Scrubber{
+		fsdata:   fsdata,
+		rate:     rate,
+		interval: interval,
+		report:   report,
+		status: hipstmr.ScrubStatus{
+			Corrupt: []string{},
+			Missing: []string{},
+		},
+	}
+}
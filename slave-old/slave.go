@@ -2,6 +2,8 @@ package main
 
 import (
 	"HipstMR/helper"
+	"HipstMR/lib/go/hipstmr"
+	"HipstMR/utils"
 	"bufio"
 	"bytes"
 	"code.google.com/p/go-uuid/uuid"
@@ -15,40 +17,88 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type JobConfig struct {
 	Mnt  string `json:"mnt"`
+	Files        map[string]string `json:"files"`
 	Jtype        string   `json:"type"`
 	Name         string   `json:"name"`
 	Dir          string   `json:"dir"`
 	Chunks       []string `json:"chunks"`
 	OutputTables []string `json:"output_tables"`
 	Object       []byte   `json:"object"`
+	Checksums    map[string]uint32 `json:"checksums"`
+	Host         string   `json:"host"`
+	ChunkSize    int64    `json:"chunk_size"`
 }
 
 type FsData struct {
-	mnt  string
-	dir  string
-	data helper.FsData
+	disks    *Disks
+	dir      string
+	data     helper.FsData
+	prepared map[string]*preparedTx
+	journal  helper.Journal
+	running  map[string]int
+	finished map[string]time.Time
+	lock     sync.Mutex
+}
+
+// preparedTx is the first phase of a two-phase commit: mutations are
+// already computed and written aside, but not yet applied. Chunks and
+// tables they touch can't be changed until the commit or the rollback,
+// so the batch stays valid and the commit can't fail on it.
+type preparedTx struct {
+	batch   []helper.Mutation
+	touched map[string]bool
 }
 
 func (self *FsData) Read() error {
 	return self.data.Read(self.dir)
 }
 
+// Recover restores the last committed metadata after a crash.
+func (self *FsData) Recover() error {
+	if err := self.Read(); err != nil {
+		return err
+	}
+
+	// the master forgets transactions of disconnected slaves, so prepared
+	// ones will never be committed
+	files, err := filepath.Glob(path.Join(self.dir, "*.prepared"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+
+	return self.data.Recover(self.GetFsDataFileName(), &self.journal)
+}
+
 func (self *FsData) ClearFs() {
-	self.data.ClearFs(self.mnt)
+	for _, mnt := range self.disks.Healthy() {
+		self.data.ClearFs(mnt)
+	}
 }
 
+// GetFs sends the master changes since the metadata version it knows.
 func (self *FsData) GetFs(trans *helper.Transaction) error {
-	if err := self.Read(); err != nil {
-		return err
-	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.attachDelta(trans, trans.Params.Since)
+}
 
-	bs, err := json.Marshal(&self.data)
+func (self *FsData) attachDelta(trans *helper.Transaction, since uint64) error {
+	delta := self.data.Delta(since)
+	bs, err := delta.MarshalBinary()
 	if err != nil {
 		return err
 	}
@@ -57,30 +107,36 @@ func (self *FsData) GetFs(trans *helper.Transaction) error {
 	return nil
 }
 
-func (self *FsData) Move(inputs []string, output string) error {
-	if err := self.Del([]string{output}); err != nil {
+// Move retags chunks of the inputs to the output with numbers chosen by
+// the master, so they are unique across slaves.
+func (self *FsData) Move(inputs []string, output string, appendMode bool, chunks []string, nums []uint64) error {
+	if !appendMode {
+		if err := self.Del([]string{output}); err != nil {
+			return err
+		}
+	}
+	if err := self.checkNumbered(inputs, chunks, nums); err != nil {
 		return err
 	}
 
-	var num uint64 = 0
-	for _, v := range self.data.Chunks {
-		for _, in := range inputs {
-			_, ok := v.Tags[in]
-			if !ok {
-				continue
-			}
-
-			delete(v.Tags, in)
-			v.Tags[output] = append(v.Tags[output], num)
-			num++
+	for _, in := range inputs {
+		for _, k := range self.data.TagChunks(in) {
+			self.data.DelTag(k, in)
 		}
 	}
+	self.addTags(output, chunks, nums)
 	return nil
 }
 
-func (self *FsData) MoveChunks(chunks []string, nums []uint64, inputs []string, output string) error {
-	if err := self.Del([]string{output}); err != nil {
-		return err
+// MoveChunks retags the chunks from the inputs to the output with the numbers.
+// Old chunks of the output are deleted, unless they are among the chunks.
+func (self *FsData) MoveChunks(chunks []string, nums []uint64, inputs []string, output string, appendMode bool) error {
+	if !appendMode {
+		keep := make(map[string]bool, len(chunks))
+		for _, chunk := range chunks {
+			keep[chunk] = true
+		}
+		self.delTable(output, keep)
 	}
 
 	for i, chunk := range chunks {
@@ -92,88 +148,416 @@ func (self *FsData) MoveChunks(chunks []string, nums []uint64, inputs []string,
 		for _, inp := range inputs {
 			for tag, _ := range ch.Tags {
 				if tag == inp {
-					delete(ch.Tags, tag)
+					self.data.DelTag(chunk, tag)
 				}
 			}
 		}
-		ch.Tags[output] = append(ch.Tags[output], nums[i])
+		self.data.AddTag(chunk, output, nums[i])
 	}
 	return nil
 }
 
-func (self *FsData) Copy(inputs []string, output string) error {
-	if err := self.Del([]string{output}); err != nil {
+func (self *FsData) Copy(inputs []string, output string, appendMode bool, chunks []string, nums []uint64) error {
+	if !appendMode {
+		if err := self.Del([]string{output}); err != nil {
+			return err
+		}
+	}
+	if err := self.checkNumbered(inputs, chunks, nums); err != nil {
 		return err
 	}
 
-	var num uint64 = 0
-	for _, v := range self.data.Chunks {
-		for _, in := range inputs {
-			_, ok := v.Tags[in]
-			if !ok {
-				continue
-			}
+	self.addTags(output, chunks, nums)
+	return nil
+}
+
+// checkNumbered fails if the master didn't number some chunks of the inputs,
+// that is the tables were changed since it looked at them.
+func (self *FsData) checkNumbered(inputs, chunks []string, nums []uint64) error {
+	if len(chunks) != len(nums) {
+		return errors.New("Numbers of output chunks don't match the chunks.")
+	}
 
-			v.Tags[output] = append(v.Tags[output], num)
-			num++
+	numbered := make(map[string]bool, len(chunks))
+	for _, chunk := range chunks {
+		numbered[chunk] = true
+	}
+	for _, in := range inputs {
+		for _, k := range self.data.TagChunks(in) {
+			if !numbered[k] {
+				return errors.New("Chunk " + k + " of table " + in + " has no output number.")
+			}
 		}
 	}
 	return nil
 }
 
+// addTags tags the chunks, which are here, with the output numbers.
+func (self *FsData) addTags(output string, chunks []string, nums []uint64) {
+	for i, chunk := range chunks {
+		if _, ok := self.data.Chunks[chunk]; ok {
+			self.data.AddTag(chunk, output, nums[i])
+		}
+	}
+}
+
 func (self *FsData) Del(inputs []string) error {
-	for k, v := range self.data.Chunks {
-		for _, in := range inputs {
-			_, ok := v.Tags[in]
-			if ok {
-				delete(v.Tags, in)
-			}
+	for _, in := range inputs {
+		self.delTable(in, nil)
+	}
+	return nil
+}
+
+// delTable removes the table, chunks left without tags are deleted
+// unless they are kept.
+func (self *FsData) delTable(tbl string, keep map[string]bool) {
+	for _, k := range self.data.TagChunks(tbl) {
+		self.data.DelTag(k, tbl)
+		if len(self.data.Chunks[k].Tags) == 0 && !keep[k] {
+			self.data.DelChunk(k)
 		}
-		if len(v.Tags) == 0 {
-			delete(self.data.Chunks, k)
-			if err := os.Remove(self.GetChunkFileName(k)); err != nil {
-				return err
+	}
+	if _, ok := self.data.Expires[tbl]; ok {
+		self.data.SetExpire(tbl, 0)
+	}
+}
+
+// SetExpire sets expiration times of tables, which have chunks here.
+func (self *FsData) SetExpire(tables []string, expires int64) {
+	for _, tbl := range tables {
+		if len(self.data.TagChunks(tbl)) != 0 {
+			self.data.SetExpire(tbl, expires)
+		}
+	}
+}
+
+// clearExpires forgets expiration times of tables, which became empty.
+func (self *FsData) clearExpires(tables []string) {
+	for _, tbl := range tables {
+		if _, ok := self.data.Expires[tbl]; ok && len(self.data.TagChunks(tbl)) == 0 {
+			self.data.SetExpire(tbl, 0)
+		}
+	}
+}
+
+// AddChunks adds chunks, which files were put here by other slaves.
+func (self *FsData) AddChunks(chunks map[string]helper.ChunkData) error {
+	for id, data := range chunks {
+		if _, ok := self.data.Chunks[id]; ok {
+			return errors.New("Chunk " + id + " already exists.")
+		}
+		self.data.AddChunk(id, self.disks.Find(id, ""), data.Size, data.Checksum)
+		for tag, nums := range data.Tags {
+			for _, n := range nums {
+				self.data.AddTag(id, tag, n)
 			}
 		}
 	}
 	return nil
 }
 
-func (self *FsData) AddChunk(id, tag string, num uint64) {
-	self.data.Chunks[id] = &helper.ChunkData{
-		Tags: map[string][]uint64{tag: []uint64{num}},
+// CheckChunks fails if the chunks are gone or their tags are not
+// the expected ones, that is the chunks were changed meanwhile.
+func (self *FsData) CheckChunks(chunks map[string]helper.ChunkData) error {
+	for id, data := range chunks {
+		ch, ok := self.data.Chunks[id]
+		if !ok {
+			return errors.New("No chunk " + id + ".")
+		}
+		if !sameTags(ch.Tags, data.Tags) {
+			return errors.New("Tags of chunk " + id + " were changed.")
+		}
 	}
+	return nil
 }
 
+// DelChunks deletes chunks with all their tags, which have to be
+// the expected ones.
+func (self *FsData) DelChunks(chunks map[string]helper.ChunkData) error {
+	if err := self.CheckChunks(chunks); err != nil {
+		return err
+	}
+	for id, _ := range chunks {
+		for tag, _ := range self.data.Chunks[id].Tags {
+			self.data.DelTag(id, tag)
+		}
+		self.data.DelChunk(id)
+	}
+	return nil
+}
+
+func sameTags(a, b helper.TagsSet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for tag, nums := range a {
+		if len(nums) != len(b[tag]) {
+			return false
+		}
+		for _, n := range nums {
+			found := false
+			for _, m := range b[tag] {
+				if n == m {
+					found = true
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// removeChunkFiles removes files of the chunks deleted by the mutations.
+func (self *FsData) removeChunkFiles(batch []helper.Mutation) error {
+	var res error = nil
+	for _, m := range batch {
+		if m.Op != "del_chunk" {
+			continue
+		}
+		if err := os.Remove(self.chunkFileName(m.Chunk)); err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
+
+func (self *FsData) AddChunk(id, disk, tag string, num, size uint64, checksum uint32) {
+	self.data.AddChunk(id, disk, size, checksum)
+	self.data.AddTag(id, tag, num)
+}
+
+// GetChunkFileName looks the chunk up on the recorded disk and then on
+// the healthy ones. The path on the first disk is returned for chunks,
+// which are not found.
 func (self *FsData) GetChunkFileName(chunk string) string {
-	return path.Join(self.mnt, chunk+".chunk")
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.chunkFileName(chunk)
 }
 
-func (self *FsData) Handle(trans helper.Transaction) error {
-	if trans.Action == "fs_move" {
-		if err := self.Move(trans.Params.Params.InputTables, trans.Params.Params.OutputTables[0]); err != nil {
+func (self *FsData) chunkFileName(chunk string) string {
+	if disk := self.chunkDisk(chunk); disk != "" {
+		return chunkPath(disk, chunk)
+	}
+	return chunkPath(self.disks.mnts[0], chunk)
+}
+
+// chunkDisk returns the disk the chunk file is on, starting with
+// the recorded one.
+func (self *FsData) chunkDisk(chunk string) string {
+	disk := ""
+	if ch, ok := self.data.Chunks[chunk]; ok {
+		disk = ch.Disk
+	}
+	return self.disks.Find(chunk, disk)
+}
+
+// chunkFiles returns paths of the chunk files, so jobs don't have to look
+// for them on every disk.
+func (self *FsData) chunkFiles(chunks []string) map[string]string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := make(map[string]string)
+	for _, id := range chunks {
+		if disk := self.chunkDisk(id); disk != "" {
+			res[id] = chunkPath(disk, id)
+		}
+	}
+	return res
+}
+
+func (self *FsData) GetFsDataFileName() string {
+	return path.Join(self.dir, "1.fsdat")
+}
+
+func (self *FsData) getPreparedFileName(id string) string {
+	return path.Join(self.dir, "1.fsdat."+id+".prepared")
+}
+
+func (self *FsData) Apply(step helper.Step) error {
+	if step.Action == "fs_move" {
+		output := step.Params.Params.OutputTables[0]
+		if err := self.Move(step.Params.Params.InputTables, output, step.Params.Params.IsAppend(output), step.Params.Chunks, step.Params.OutputChunkNums); err != nil {
+			return err
+		}
+	} else if step.Action == "fs_move_chunks" {
+		output := step.Params.OutputTables[0]
+		if err := self.MoveChunks(step.Params.Chunks, step.Params.OutputChunkNums, step.Params.Params.InputTables, output, step.Params.Params.IsAppend(output)); err != nil {
+			return err
+		}
+	} else if step.Action == "fs_copy" {
+		output := step.Params.Params.OutputTables[0]
+		if err := self.Copy(step.Params.Params.InputTables, output, step.Params.Params.IsAppend(output), step.Params.Chunks, step.Params.OutputChunkNums); err != nil {
+			return err
+		}
+	} else if step.Action == "fs_drop" {
+		if err := self.Del(step.Params.Params.InputTables); err != nil {
+			return err
+		}
+	} else if step.Action == "fs_set_expire" {
+		self.SetExpire(step.Params.Params.InputTables, step.Params.Expires)
+	} else if step.Action == "fs_add_chunks" {
+		if err := self.AddChunks(step.Params.ChunksData); err != nil {
 			return err
 		}
-	} else if trans.Action == "fs_move_chunks" {
-		if err := self.MoveChunks(trans.Params.Chunks, trans.Params.OutputChunkNums, trans.Params.Params.InputTables, trans.Params.OutputTables[0]); err != nil {
+	} else if step.Action == "fs_check_chunks" {
+		if err := self.CheckChunks(step.Params.ChunksData); err != nil {
 			return err
 		}
-	} else if trans.Action == "fs_copy" {
-		if err := self.Copy(trans.Params.Params.InputTables, trans.Params.Params.OutputTables[0]); err != nil {
+	} else if step.Action == "fs_del_chunks" {
+		if err := self.DelChunks(step.Params.ChunksData); err != nil {
 			return err
 		}
-	} else if trans.Action == "fs_drop" {
-		if err := self.Del(trans.Params.Params.InputTables); err != nil {
+	} else {
+		return errors.New("Unknown fs action " + step.Action + ".")
+	}
+	self.clearExpires(step.Params.Params.InputTables)
+	return nil
+}
+
+// applySteps applies all the steps or none of them.
+func (self *FsData) applySteps(steps []helper.Step) error {
+	mark := self.data.Mark()
+	for _, step := range steps {
+		if err := self.Apply(step); err != nil {
+			self.data.Undo(mark)
 			return err
 		}
 	}
+	return nil
+}
+
+// Flush commits the pending mutations, unless they change something
+// a prepared transaction relies on. Mutations, which failed to commit,
+// are undone.
+func (self *FsData) Flush() error {
+	batch := self.data.Pending()
+	if err := self.checkPrepared(batch); err != nil {
+		self.data.Undo(0)
+		return err
+	}
+	if err := self.data.Commit(self.GetFsDataFileName(), &self.journal); err != nil {
+		self.data.Undo(0)
+		return err
+	}
+	return self.removeChunkFiles(batch)
+}
+
+// touchedBy returns chunks and tables changed by the mutations.
+func touchedBy(batch []helper.Mutation) map[string]bool {
+	res := make(map[string]bool)
+	for _, m := range batch {
+		if m.Chunk != "" {
+			res["chunk "+m.Chunk] = true
+		}
+		if m.Tag != "" && m.Op != "add_chunk" && m.Op != "set_disk" {
+			res["table "+m.Tag] = true
+		}
+	}
+	return res
+}
+
+func (self *FsData) checkPrepared(batch []helper.Mutation) error {
+	if len(self.prepared) == 0 {
+		return nil
+	}
+	for k, _ := range touchedBy(batch) {
+		for id, tx := range self.prepared {
+			if tx.touched[k] {
+				return errors.New("The " + k + " is locked by prepared transaction " + id + ".")
+			}
+		}
+	}
+	return nil
+}
+
+func (self *FsData) Prepare(id string, steps []helper.Step) error {
+	mark := self.data.Mark()
+	if err := self.applySteps(steps); err != nil {
+		return err
+	}
+	batch := append([]helper.Mutation{}, self.data.Pending()[mark:]...)
+	self.data.Undo(mark)
+	if err := self.checkPrepared(batch); err != nil {
+		return err
+	}
+
+	prepared := helper.Batch{
+		Mutations: batch,
+	}
+	bs, err := prepared.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := helper.WriteFileAtomic(self.getPreparedFileName(id), bs); err != nil {
+		return err
+	}
 
-	if err := self.data.Write("1.fsdat"); err != nil {
+	self.prepared[id] = &preparedTx{
+		batch:   batch,
+		touched: touchedBy(batch),
+	}
+	return nil
+}
+
+func (self *FsData) Commit(id string) error {
+	tx, ok := self.prepared[id]
+	if !ok {
+		return errors.New("No prepared transaction " + id + ".")
+	}
+	delete(self.prepared, id)
+
+	self.data.Mutate(tx.batch)
+	if err := self.Flush(); err != nil {
 		return err
 	}
+
+	if err := os.Remove(self.getPreparedFileName(id)); err != nil {
+		fmt.Println("Error Commit:", err)
+	}
 	return nil
 }
 
+func (self *FsData) Rollback(id string) error {
+	if _, ok := self.prepared[id]; !ok {
+		return nil
+	}
+	delete(self.prepared, id)
+	return os.Remove(self.getPreparedFileName(id))
+}
+
+// Handle runs a metadata operation and attaches its changes to the
+// transaction, so the master doesn't have to ask for them.
+func (self *FsData) Handle(trans *helper.Transaction) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	since := self.data.Seq
+	if err := self.handle(*trans); err != nil {
+		return err
+	}
+	return self.attachDelta(trans, since)
+}
+
+func (self *FsData) handle(trans helper.Transaction) error {
+	switch trans.Action {
+	case "fs_prepare":
+		return self.Prepare(trans.Id, trans.Params.Steps)
+	case "fs_commit":
+		return self.Commit(trans.Params.Prepared)
+	case "fs_rollback":
+		return self.Rollback(trans.Params.Prepared)
+	}
+
+	if err := self.applySteps([]helper.Step{{Action: trans.Action, Params: trans.Params}}); err != nil {
+		return err
+	}
+	return self.Flush()
+}
+
 func dumpTransaction(trans helper.Transaction) (string, error) {
 	res := ""
 	for k, v := range trans.Params.Params.Files {
@@ -206,7 +590,29 @@ func dumpTransaction(trans helper.Transaction) (string, error) {
 	return res, nil
 }
 
+// startJob and finishJob track transactions with jobs on the slave,
+// so garbage collection doesn't remove their data before the master
+// knows about them.
+func (self *FsData) startJob(id string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.running[id]++
+}
+
+func (self *FsData) finishJob(id string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.running[id]--
+	if self.running[id] == 0 {
+		delete(self.running, id)
+	}
+	self.finished[id] = time.Now()
+}
+
 func (self *FsData) DoMap(master *Master, trans *helper.Transaction) error {
+	self.startJob(trans.Id)
+	defer self.finishJob(trans.Id)
+
 	bin, err := dumpTransaction(*trans)
 	if err != nil {
 		return err
@@ -217,14 +623,23 @@ func (self *FsData) DoMap(master *Master, trans *helper.Transaction) error {
 		return err
 	}
 
+	disk, err := self.disks.Pick(self.inputSize(trans.Params.Chunks))
+	if err != nil {
+		return err
+	}
+
 	cfg := JobConfig{
-		Mnt: self.mnt,
+		Mnt: disk,
 		Dir:          path.Join(trans.Id, uuid.New()),
 		Jtype:        trans.Params.Params.Type,
 		Name:         trans.Params.Params.Name,
 		Object:       trans.Params.Params.Object,
 		Chunks:       trans.Params.Chunks,
 		OutputTables: trans.Params.OutputTables,
+		Checksums:    self.checksums(trans.Params.Chunks),
+		Files:        self.chunkFiles(trans.Params.Chunks),
+		Host:         helper.Hostname(),
+		ChunkSize:    trans.Params.Params.ChunkSize,
 	}
 
 	buf, err := json.Marshal(cfg)
@@ -248,11 +663,104 @@ func (self *FsData) DoMap(master *Master, trans *helper.Transaction) error {
 	fmt.Println("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
 
 	if err != nil {
+		if self.disks.isFull(disk) {
+			return noSpaceError{jobError(err, stderr.Bytes())}
+		}
+		return jobError(err, stderr.Bytes())
+	}
+
+	if err := self.registerOutputs(cfg); err != nil {
+		return err
+	}
+
+	// TODO: put in safe place (defer?)
+	if err := os.RemoveAll(path.Join(disk, trans.Id)); err != nil {
+		return err
+	}
+
+	trans.Status = "finished"
+	trans.Payload = string(stderr.Bytes())
+	return nil
+}
+
+// checksums returns known checksums of the chunks, so the job can verify
+// what it reads.
+func (self *FsData) checksums(chunks []string) map[string]uint32 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := make(map[string]uint32)
+	for _, id := range chunks {
+		ch, ok := self.data.Chunks[id]
+		if ok && ch.Checksum != 0 {
+			res[id] = ch.Checksum
+		}
+	}
+	return res
+}
+
+// inputSize estimates space needed for outputs of a job by the size
+// of its input.
+func (self *FsData) inputSize(chunks []string) uint64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	var res uint64 = 0
+	for _, id := range chunks {
+		if ch, ok := self.data.Chunks[id]; ok {
+			res += ch.Size
+		}
+	}
+	return res
+}
+
+func (self *FsData) chunkIds() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := make([]string, 0, len(self.data.Chunks))
+	for id, _ := range self.data.Chunks {
+		res = append(res, id)
+	}
+	return res
+}
+
+func (self *FsData) hasChunk(id string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	_, ok := self.data.Chunks[id]
+	return ok
+}
+
+// jobError adds the last line of the job stderr, where it reports
+// the reason of the failure, to the error.
+func jobError(err error, stderr []byte) error {
+	lines := strings.Split(strings.TrimSpace(string(stderr)), "\n")
+	last := strings.TrimSpace(lines[len(lines)-1])
+	if last == "" {
 		return err
 	}
+	return errors.New(err.Error() + ": " + last)
+}
 
+// registerOutputs moves chunks written by the job to the root of its disk
+// and adds them to the metadata.
+func (self *FsData) registerOutputs(cfg JobConfig) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	mark := self.data.Mark()
+	if err := self.addOutputs(cfg); err != nil {
+		self.data.Undo(mark)
+		return err
+	}
+	return self.Flush()
+}
+
+func (self *FsData) addOutputs(cfg JobConfig) error {
 	for _, tbl := range cfg.OutputTables {
-		p := path.Clean(path.Join(self.mnt, cfg.Dir, tbl))
+		p := path.Clean(path.Join(cfg.Mnt, cfg.Dir, tbl))
 		dir, err := ioutil.ReadDir(p)
 		if err != nil {
 			return err
@@ -261,6 +769,9 @@ func (self *FsData) DoMap(master *Master, trans *helper.Transaction) error {
 		chunkSuffix := ".chunk"
 		for _, v := range dir {
 			nm := v.Name()
+			if !v.IsDir() && strings.HasSuffix(nm, chunkSuffix+utils.ChecksumSuffix) {
+				continue
+			}
 			if v.IsDir() || !strings.HasSuffix(nm, chunkSuffix) {
 				return errors.New(nm + " is not a chunk.")
 			}
@@ -270,43 +781,51 @@ func (self *FsData) DoMap(master *Master, trans *helper.Transaction) error {
 				return err
 			}
 
+			// jobs put checksums next to chunks while writing them,
+			// ones built with an older library don't
+			size := uint64(v.Size())
+			checksum, err := utils.ReadChecksum(path.Join(p, nm))
+			if os.IsNotExist(err) {
+				checksum, size, err = helper.FileChecksum(path.Join(p, nm))
+			}
+			if err != nil {
+				return err
+			}
+
 			id := uuid.New()
-			if err := os.Rename(path.Join(p, nm), path.Join(self.mnt, id+chunkSuffix)); err != nil {
+			if err := os.Rename(path.Join(p, nm), chunkPath(cfg.Mnt, id)); err != nil {
 				return err
 			}
-			fmt.Println("Rename", path.Join(p, nm), "to", path.Join(self.mnt, id+chunkSuffix))
-			self.AddChunk(id, tbl, num)
+			fmt.Println("Rename", path.Join(p, nm), "to", chunkPath(cfg.Mnt, id))
+			self.AddChunk(id, cfg.Mnt, tbl, num, size, checksum)
 		}
 	}
-
-	if err := self.data.Write("1.fsdat"); err != nil {
-		return err
-	}
-
-	// TODO: put in safe place (defer?)
-	if err := os.RemoveAll(path.Join(self.mnt, trans.Id)); err != nil {
-		return err
-	}
-
-	trans.Status = "finished"
-	trans.Payload = string(stderr.Bytes())
 	return nil
 }
 
-func NewFsData(mnt, dir string) FsData {
+func NewFsData(mnts []string, dir string, reserve uint64) FsData {
 	return FsData{
-		mnt:  path.Clean(mnt),
-		dir:  path.Clean(dir),
-		data: helper.FsData{},
+		disks:    NewDisks(mnts, reserve),
+		dir:      path.Clean(dir),
+		data:     helper.FsData{},
+		prepared: make(map[string]*preparedTx),
+		running:  make(map[string]int),
+		finished: make(map[string]time.Time),
+		journal:  helper.NewJournal(path.Join(path.Clean(dir), "1.fsdat.wal")),
 	}
 }
 
 type Master struct {
-	address string
-	conn    net.Conn
-	decoder *json.Decoder
+	address  string
+	conn     net.Conn
+	decoder  *json.Decoder
+	pending  map[string]chan helper.Transaction
+	lock     sync.Mutex
+	sendLock sync.Mutex
 }
 
+// Loop handles transactions concurrently, replies are matched by the master
+// by their ids. Metadata operations never wait for running jobs.
 func (self *Master) Loop(slave *Slave) {
 	for {
 		var trans helper.Transaction
@@ -320,10 +839,15 @@ func (self *Master) Loop(slave *Slave) {
 			continue
 		}
 
-		if err := slave.Handle(self, trans); err != nil {
-			self.Failed(trans, err)
+		if self.reply(trans) {
 			continue
 		}
+
+		go func(trans helper.Transaction) {
+			if err := slave.Handle(self, trans); err != nil {
+				self.Failed(trans, err)
+			}
+		}(trans)
 	}
 	slave.OnDisconnected(self)
 }
@@ -332,15 +856,59 @@ func (self *Master) Failed(trans helper.Transaction, origErr error) {
 	trans.Params.Params = nil
 	trans.Params.Chunks = nil
 	trans.Params.OutputTables = nil
-	trans.Payload = nil
+	trans.Payload = origErr.Error()
 	trans.Status = "failed"
+	if _, ok := origErr.(noSpaceError); ok {
+		trans.Status = "no_space"
+	}
 	fmt.Println(origErr)
 	if err := self.Send(trans); err != nil {
 		fmt.Println("Errors:", origErr, err)
 	}
 }
 
+// Query sends a request of the slave and waits for the reply.
+func (self *Master) Query(trans helper.Transaction, timeout time.Duration) (helper.Transaction, error) {
+	ch := make(chan helper.Transaction, 1)
+	self.lock.Lock()
+	self.pending[trans.Id] = ch
+	self.lock.Unlock()
+
+	defer func() {
+		self.lock.Lock()
+		delete(self.pending, trans.Id)
+		self.lock.Unlock()
+	}()
+
+	if err := self.Send(trans); err != nil {
+		return helper.Transaction{}, err
+	}
+
+	select {
+	case res := <-ch:
+		if res.Status != "finished" {
+			return res, errors.New("Master " + self.address + " failed to answer " + trans.Action + ".")
+		}
+		return res, nil
+	case <-time.After(timeout):
+		return helper.Transaction{}, errors.New("Master " + self.address + " didn't answer " + trans.Action + " in time.")
+	}
+}
+
+// reply passes replies to requests of the slave to Query.
+func (self *Master) reply(trans helper.Transaction) bool {
+	self.lock.Lock()
+	ch, ok := self.pending[trans.Id]
+	self.lock.Unlock()
+	if ok {
+		ch <- trans
+	}
+	return ok
+}
+
 func (self *Master) Send(trans helper.Transaction) error {
+	self.sendLock.Lock()
+	defer self.sendLock.Unlock()
 	return trans.Send(self.conn)
 }
 
@@ -348,32 +916,41 @@ func (self *Master) Close() error {
 	return self.conn.Close()
 }
 
-func NewMaster(addr string) (Master, error) {
+func NewMaster(addr string) (*Master, error) {
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
-		return Master{}, err
+		return nil, err
 	}
 
-	return Master{
+	return &Master{
 		address: addr,
 		conn:    conn,
 		decoder: json.NewDecoder(bufio.NewReader(conn)),
+		pending: make(map[string]chan helper.Transaction),
 	}, nil
 }
 
 
 type Slave struct {
-	masters map[string]Master
+	masters map[string]*Master
 	fsdata  FsData
+	jobs    chan struct{}
+	info    helper.SlaveInfo
+	grace   time.Duration
+	lock    sync.Mutex
 }
 
 func (self *Slave) Connect(addr string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
 	_, ok := self.masters[addr]
 	if ok {
 		return errors.New("There is already a connection to master " + addr)
 	}
 
 	trans := helper.NewTransaction("connect_slave")
+	trans.Payload = self.info
 	master, err := NewMaster(addr)
 	if err != nil {
 		return err
@@ -390,7 +967,56 @@ func (self *Slave) Connect(addr string) error {
 	return nil
 }
 
+func (self *Slave) broadcast(trans helper.Transaction) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for _, master := range self.masters {
+		if err := master.Send(trans); err != nil {
+			fmt.Println("Error Report:", err)
+		}
+	}
+}
+
+// Report sends scrub status to all masters.
+func (self *Slave) Report(status hipstmr.ScrubStatus) {
+	trans := helper.NewTransaction("scrub_report")
+	trans.Payload = status
+	self.broadcast(trans)
+}
+
+func (self *Slave) ReportGc(status hipstmr.GcStatus) {
+	trans := helper.NewTransaction("gc_report")
+	trans.Payload = status
+	self.broadcast(trans)
+}
+
+// Heartbeat sends space of the disks to all masters every interval.
+func (self *Slave) Heartbeat(interval time.Duration) {
+	for {
+		trans := helper.NewTransaction("heartbeat")
+		trans.Payload = self.fsdata.disks.Check()
+		self.broadcast(trans)
+		time.Sleep(interval)
+	}
+}
+
+// getMasters returns masters the slave is connected to.
+func (self *Slave) getMasters() []*Master {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	res := make([]*Master, 0, len(self.masters))
+	for _, master := range self.masters {
+		res = append(res, master)
+	}
+	return res
+}
+
 func (self *Slave) OnDisconnected(master *Master) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
 	delete(self.masters, master.address)
 	if len(self.masters) == 0 {
 		panic("No active masters!")
@@ -398,6 +1024,9 @@ func (self *Slave) OnDisconnected(master *Master) {
 }
 
 func (self *Slave) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
 	var err error = nil
 	for _, v := range self.masters {
 		err = v.Close()
@@ -412,11 +1041,21 @@ func (self *Slave) Handle(master *Master, trans helper.Transaction) error {
 		if err != nil {
 			return err
 		}
+	} else if trans.Action == "fsck" {
+		if err := self.fsdata.Fsck(&trans, self.grace); err != nil {
+			return err
+		}
 	} else if trans.Action[:3] == "fs_" {
-		if err := self.fsdata.Handle(trans); err != nil {
+		if err := self.fsdata.Handle(&trans); err != nil {
 			return err
 		}
 	} else if trans.Action == "mr_map" {
+		// jobs are limited, so they don't take all the resources
+		self.jobs <- struct{}{}
+		defer func() {
+			<-self.jobs
+		}()
+
 		if err := os.Mkdir(trans.Id, os.ModeTemporary|os.ModeDir|os.ModePerm); err != nil {
 			return err
 		}
@@ -428,6 +1067,15 @@ func (self *Slave) Handle(master *Master, trans helper.Transaction) error {
 		if errMap != nil {
 			return errMap
 		}
+	} else if trans.Action == "mr_merge" {
+		self.jobs <- struct{}{}
+		defer func() {
+			<-self.jobs
+		}()
+
+		if err := self.fsdata.DoMerge(&trans); err != nil {
+			return err
+		}
 	}
 	trans.Status = "finished"
 	fmt.Println("~", trans)
@@ -435,37 +1083,79 @@ func (self *Slave) Handle(master *Master, trans helper.Transaction) error {
 	return nil
 }
 
-func NewSlave(mnt, dir string) Slave {
-	return Slave{
-		masters: make(map[string]Master),
-		fsdata:  NewFsData(mnt, dir),
+func NewSlave(mnts []string, dir string, jobs int, info helper.SlaveInfo, reserve uint64) *Slave {
+	return &Slave{
+		masters: make(map[string]*Master),
+		fsdata:  NewFsData(mnts, dir, reserve),
+		jobs:    make(chan struct{}, jobs),
+		info:    info,
 	}
 }
 
 func main() {
 	help := flag.Bool("help", false, "print this help")
 	master := flag.String("master", "", "master adress")
-	mntv := flag.String("mnt", "", "mount point")
+	mntv := flag.String("mnt", "", "comma separated mount points")
+	jobs := flag.Int("jobs", 4, "max number of concurrently running jobs")
+	fileserver := flag.String("fileserver", "", "address of the fileserver serving the mount point")
+	scrubRate := flag.Int64("scrub-rate", 8<<20, "bytes per second to verify chunks at, 0 disables scrubbing")
+	scrubInterval := flag.Duration("scrub-interval", time.Hour, "pause between scrub passes")
+	gcInterval := flag.Duration("gc-interval", 10*time.Minute, "pause between garbage collections, 0 disables them")
+	gcGrace := flag.Duration("gc-grace", time.Hour, "age of orphan chunk files to remove by gc and fsck")
+	gcDryRun := flag.Bool("gc-dry-run", false, "only report what garbage collection would remove")
+	reserve := flag.Uint64("disk-reserve", 256<<20, "bytes to keep free on every mount point")
+	heartbeatInterval := flag.Duration("heartbeat-interval", 10*time.Second, "pause between reports of disk space to masters")
+	cfgFile := flag.String("config", "", "cluster config with the rack and labels of the machine")
+	name := flag.String("name", "", "machine name in the config")
 	flag.Parse()
-	if *help || *master == "" || *mntv == "" {
+	if *help || *master == "" || *mntv == "" || *jobs <= 0 || (*cfgFile == "") != (*name == "") {
 		flag.PrintDefaults()
 		return
 	}
 
-	slave := NewSlave(*mntv, "./")
+	info := helper.SlaveInfo{
+		Fileserver: *fileserver,
+	}
+	if *cfgFile != "" {
+		cfg, err := utils.NewConfig(*cfgFile)
+		if err != nil {
+			panic(err)
+		}
+		nodeCfg := cfg.GetMachineCfg(*name)
+		if nodeCfg == nil {
+			panic("No machine with name \"" + *name + "\".")
+		}
+		info.Machine = *name
+		info.Rack = nodeCfg.Rack
+		info.Labels = nodeCfg.Labels
+	}
+
+	slave := NewSlave(strings.Split(*mntv, ","), "./", *jobs, info, *reserve)
+	slave.grace = *gcGrace
 	defer slave.Close()
 
-	if err := slave.fsdata.Read(); err != nil {
+	if err := slave.fsdata.Recover(); err != nil {
 		panic(err)
 	}
-	slave.fsdata.data.Write("1.fsdat")
+	slave.fsdata.data.Write(slave.fsdata.GetFsDataFileName())
+	slave.fsdata.disks.Check()
 	slave.fsdata.ClearFs()
 
-	fmt.Println(slave.fsdata)
+	fmt.Println("Chunks:", len(slave.fsdata.data.Chunks))
 
 	if err := slave.Connect(*master); err != nil {
 		panic(err)
 	}
 
+	if *scrubRate > 0 {
+		go NewScrubber(&slave.fsdata, *scrubRate, *scrubInterval, slave.Report).Run()
+	}
+
+	if *gcInterval > 0 {
+		go NewCollector(slave, *gcInterval, *gcGrace, *gcDryRun).Run()
+	}
+
+	go slave.Heartbeat(*heartbeatInterval)
+
 	select {}
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"HipstMR/helper"
+	"path"
+	"testing"
+)
+
+func TestFlushUndoesFailedCommit(t *testing.T) {
+	fsdata, mnt := newTestFsData(t)
+	// the journal can't be created in a missing directory
+	fsdata.journal = helper.NewJournal(path.Join(mnt, "missing", "1.fsdat.wal"))
+
+	fsdata.lock.Lock()
+	defer fsdata.lock.Unlock()
+	fsdata.AddChunk("a", mnt, "t", 0, 1, 0)
+	if err := fsdata.Flush(); err == nil {
+		t.Fatal("commit to the missing journal succeeded")
+	}
+	if _, ok := fsdata.data.Chunks["a"]; ok {
+		t.Error("chunk of the failed commit is left in the metadata")
+	}
+	if len(fsdata.data.Pending()) != 0 {
+		t.Error("mutations of the failed commit are pending:", fsdata.data.Pending())
+	}
+}
+
+func TestMoveChunksKeepsListedChunks(t *testing.T) {
+	fsdata, mnt := newTestFsData(t)
+	fsdata.AddChunk("kept", mnt, "t", 3, 1, 0)
+	fsdata.AddChunk("old", mnt, "t", 4, 1, 0)
+	fsdata.AddChunk("new", mnt, "tmp/tr/t", 0, 1, 0)
+
+	if err := fsdata.MoveChunks([]string{"new", "kept"}, []uint64{0, 1}, []string{"tmp/tr/t"}, "t", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fsdata.data.Chunks["old"]; ok {
+		t.Error("old chunk of the table is left")
+	}
+	for chunk, num := range map[string]uint64{"new": 0, "kept": 1} {
+		ch, ok := fsdata.data.Chunks[chunk]
+		if !ok {
+			t.Errorf("chunk %s is deleted", chunk)
+			continue
+		}
+		if nums := ch.Tags["t"]; len(ch.Tags) != 1 || len(nums) != 1 || nums[0] != num {
+			t.Errorf("chunk %s is tagged %v", chunk, ch.Tags)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"hash/crc32"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Castagnoli is the crc32c table chunks are checked with. It is here
+// rather than in helper, as the job library can't depend on helper.
+var Castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumSuffix is appended to the name of a chunk file written by a job
+// to get the file with its crc32c, so slaves don't have to read it again.
+const ChecksumSuffix = ".crc32c"
+
+func WriteChecksum(chunkFile string, sum uint32) error {
+	return ioutil.WriteFile(chunkFile+ChecksumSuffix, []byte(strconv.FormatUint(uint64(sum), 16)), 0644)
+}
+
+func ReadChecksum(chunkFile string) (uint32, error) {
+	bs, err := ioutil.ReadFile(chunkFile + ChecksumSuffix)
+	if err != nil {
+		return 0, err
+	}
+	sum, err := strconv.ParseUint(strings.TrimSpace(string(bs)), 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(sum), nil
+}
@@ -5,14 +5,35 @@ import (
 	"encoding/json"
 )
 
+// Mnts are mount points of disks, a single one may be set by Mnt.
+// Reserve is bytes kept free on every mount.
 type FileserverCfg struct {
 	Port string `json:"port"`
 	Mnt string `json:"mnt"`
+	Mnts []string `json:"mnts"`
+	Writable []string `json:"writable"`
+	Reserve uint64 `json:"reserve"`
+}
+
+func (self *FileserverCfg) Mounts() []string {
+	return mounts(self.Mnt, self.Mnts)
 }
 
 type FilesystemSlaveCfg struct {
 	Port string `json:"port"`
 	Mnt string `json:"mnt"`
+	Mnts []string `json:"mnts"`
+}
+
+func (self *FilesystemSlaveCfg) Mounts() []string {
+	return mounts(self.Mnt, self.Mnts)
+}
+
+func mounts(mnt string, mnts []string) []string {
+	if mnt == "" {
+		return mnts
+	}
+	return append([]string{mnt}, mnts...)
 }
 
 type MasterCfg struct {
@@ -25,8 +46,14 @@ type BinariesCfg struct {
 	Master string `json:"master"`
 }
 
+// Name tells machines with the same address apart, the address is the name
+// by default. Replicas of a chunk are not placed in one Rack, jobs may
+// be constrained to machines with some Labels.
 type MachineCfg struct {
+	Name string `json:"name"`
 	Addr string `json:"address"`
+	Rack string `json:"rack"`
+	Labels map[string]string `json:"labels"`
 	Binaries BinariesCfg `json:"binaries"`
 	Fileservers []FileserverCfg `json:"fileservers"`
 	FilesystemSlaves []FilesystemSlaveCfg `json:"filesystem_slaves"`
@@ -41,7 +68,7 @@ type Config struct {
 func (self *Config) GetMachineCfg(name string) *MachineCfg {
 	var nodeCfg *MachineCfg = nil
 	for _, v := range self.Data {
-		if v.Addr == name {
+		if v.Name == name || (v.Name == "" && v.Addr == name) {
 			nodeCfg = &v
 			break
 		}
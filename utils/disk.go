@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// FreeSpace returns bytes available to unprivileged users on the file
+// system of the directory.
+func FreeSpace(dir string) (uint64, error) {
+	free, _, err := DiskSpace(dir)
+	return free, err
+}
+
+// DiskSpace returns available and total bytes of the file system
+// of the directory.
+func DiskSpace(dir string) (uint64, uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil
+}
+
+// MostAvailable returns the directory with the most bytes available above
+// the reserve and these bytes. Directories, which file systems can't be
+// queried, are skipped.
+func MostAvailable(dirs []string, reserve uint64) (string, uint64, error) {
+	res := ""
+	var best uint64 = 0
+	for _, dir := range dirs {
+		free, err := FreeSpace(dir)
+		if err != nil {
+			continue
+		}
+		var available uint64 = 0
+		if free > reserve {
+			available = free - reserve
+		}
+		if res == "" || available > best {
+			res = dir
+			best = available
+		}
+	}
+	if res == "" {
+		return "", 0, errors.New("No file system of " + strings.Join(dirs, ", ") + " can be queried.")
+	}
+	return res, best, nil
+}
+
+// IsNoSpace tells if the error is caused by a full file system.
+func IsNoSpace(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return err == syscall.ENOSPC || err == syscall.EDQUOT
+}